@@ -0,0 +1,251 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+
+	pkgcli "github.com/IceFireDB/cli/pkg/cli"
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/IceFireDB/kit/pkg/models/client"
+	zkclient "github.com/IceFireDB/kit/pkg/models/client/zk"
+	"github.com/c4pt0r/cfg"
+	"github.com/juju/errors"
+	"github.com/ledisdb/xcodis/utils"
+	"github.com/urfave/cli/v2"
+)
+
+const defaultCoordinatorTimeout = "5s"
+
+// coordinatorFlags override the coordinator_* keys of the config file.
+var coordinatorFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "coordinator-addr",
+		Usage: "coordinator endpoints, comma separated",
+	},
+	&cli.StringFlag{
+		Name:  "coordinator-user",
+		Usage: "coordinator user (etcd user, zookeeper digest user)",
+	},
+	&cli.StringFlag{
+		Name:    "coordinator-password",
+		Usage:   "coordinator password",
+		EnvVars: []string{"ICEFIREDB_COORDINATOR_PASSWORD"},
+	},
+	&cli.StringFlag{
+		Name:  "coordinator-tls-ca",
+		Usage: "CA file to verify the coordinator, enables TLS",
+	},
+	&cli.StringFlag{
+		Name:  "coordinator-tls-cert",
+		Usage: "client certificate file for the coordinator, enables TLS",
+	},
+	&cli.StringFlag{
+		Name:  "coordinator-tls-key",
+		Usage: "client key file for the coordinator",
+	},
+	&cli.StringFlag{
+		Name:  "coordinator-tls-server-name",
+		Usage: "server name to verify the coordinator certificate against",
+	},
+	&cli.BoolFlag{
+		Name:  "coordinator-tls-skip-verify",
+		Usage: "do not verify the coordinator certificate, enables TLS",
+	},
+	&cli.StringFlag{
+		Name:  "coordinator-dial-timeout",
+		Usage: "timeout to connect to the coordinator (default " + defaultCoordinatorTimeout + ")",
+	},
+	&cli.StringFlag{
+		Name:  "coordinator-timeout",
+		Usage: "timeout of a coordinator request, session timeout for zookeeper (default " + defaultCoordinatorTimeout + ")",
+	},
+}
+
+// setting returns the flag when given, else the config key. Without ctx
+// only the config is read.
+func setting(conf *cfg.Cfg, ctx *cli.Context, flag, key, def string) string {
+	if ctx != nil && ctx.IsSet(flag) {
+		return ctx.String(flag)
+	}
+	v, _ := conf.ReadString(key, def)
+	return v
+}
+
+func settingBool(conf *cfg.Cfg, ctx *cli.Context, flag, key string) bool {
+	if ctx != nil && ctx.IsSet(flag) {
+		return ctx.Bool(flag)
+	}
+	v, _ := conf.ReadString(key, "false")
+	return v == "true"
+}
+
+func settingDuration(conf *cfg.Cfg, ctx *cli.Context, flag, key string) (time.Duration, error) {
+	v := setting(conf, ctx, flag, key, defaultCoordinatorTimeout)
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("invalid %s %q", key, v)
+	}
+	return d, nil
+}
+
+// newCoordinatorClient connects to the coordinator, e.g.
+//
+//	coordinator_type=etcd
+//	coordinator_addr=10.0.0.1:2379,10.0.0.2:2379,10.0.0.3:2379
+//	coordinator_user=cli
+//	coordinator_password=secret
+//	coordinator_tls_ca=/etc/etcd/ca.pem
+//	coordinator_tls_cert=/etc/etcd/cli.pem
+//	coordinator_tls_key=/etc/etcd/cli-key.pem
+//	coordinator_dial_timeout=3s
+//	coordinator_timeout=5s
+//
+// etcd takes the user and password as credentials, zookeeper as digest
+// auth. Any coordinator_tls_* key or an https endpoint turns on TLS, only
+// etcd v3 supports it. The flags of ctx override conf, ctx is nil for the
+// config of another cluster. The lock client takes the product lock on
+// the same coordinator.
+func newCoordinatorClient(conf *cfg.Cfg, ctx *cli.Context) (client.Client, pkgcli.LockClient, error) {
+	coordinatorType, _ := conf.ReadString("coordinator_type", "etcd")
+	addr := setting(conf, ctx, "coordinator-addr", "coordinator_addr", "localhost:2379")
+	user := setting(conf, ctx, "coordinator-user", "coordinator_user", "")
+	password := setting(conf, ctx, "coordinator-password", "coordinator_password", "")
+	if password != "" && user == "" {
+		return nil, nil, errors.New("coordinator password is set without a user")
+	}
+	dialTimeout, err := settingDuration(conf, ctx, "coordinator-dial-timeout", "coordinator_dial_timeout")
+	if err != nil {
+		return nil, nil, err
+	}
+	timeout, err := settingDuration(conf, ctx, "coordinator-timeout", "coordinator_timeout")
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig, err := coordinatorTLS(conf, ctx, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch coordinatorType {
+	case "etcd":
+		ec, err := pkgcli.DialEtcd(addr, user, password, tlsConfig, dialTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		return pkgcli.NewEtcdClient(ec, timeout), pkgcli.NewEtcdLockClient(ec, timeout), nil
+	case "zk", "zookeeper", "etcdv2":
+		if tlsConfig != nil {
+			return nil, nil, errors.Errorf("coordinator TLS is only supported with coordinator_type=etcd, not %s", coordinatorType)
+		}
+	default:
+		return nil, nil, errors.Errorf("invalid coordinator_type %s", coordinatorType)
+	}
+
+	auth := ""
+	if user != "" {
+		auth = user + ":" + password
+	}
+	c, err := dialCoordinator(coordinatorType, addr, auth, dialTimeout, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if coordinatorType == "etcdv2" {
+		lc, err := pkgcli.NewEtcdV2LockClient(addr, user, password, timeout)
+		if err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+		return c, lc, nil
+	}
+	zc, ok := c.(*zkclient.Client)
+	if !ok {
+		c.Close()
+		return nil, nil, errors.Errorf("unexpected zookeeper client %T", c)
+	}
+	return c, pkgcli.NewZkLockClient(zc), nil
+}
+
+// coordinatorTLS returns nil when no TLS setting is given.
+func coordinatorTLS(conf *cfg.Cfg, ctx *cli.Context, addr string) (*tls.Config, error) {
+	ca := setting(conf, ctx, "coordinator-tls-ca", "coordinator_tls_ca", "")
+	cert := setting(conf, ctx, "coordinator-tls-cert", "coordinator_tls_cert", "")
+	key := setting(conf, ctx, "coordinator-tls-key", "coordinator_tls_key", "")
+	serverName := setting(conf, ctx, "coordinator-tls-server-name", "coordinator_tls_server_name", "")
+	skipVerify := settingBool(conf, ctx, "coordinator-tls-skip-verify", "coordinator_tls_skip_verify")
+	if ca == "" && cert == "" && key == "" && serverName == "" && !skipVerify && !strings.Contains(addr, "https://") {
+		return nil, nil
+	}
+	c, err := pkgcli.LoadTLSConfig(ca, cert, key, serverName, skipVerify)
+	if err != nil {
+		return nil, errors.Annotatef(err, "coordinator tls")
+	}
+	return c, nil
+}
+
+// dialCoordinator creates the kit client of zookeeper or etcd v2 and waits up to dialTimeout for a
+// first answer, the kit clients only take the request / session timeout.
+func dialCoordinator(coordinatorType, addr, auth string, dialTimeout, timeout time.Duration) (client.Client, error) {
+	type dialed struct {
+		c   client.Client
+		err error
+	}
+	done := make(chan dialed, 1)
+	go func() {
+		c, err := models.NewClient(coordinatorType, addr, auth, timeout)
+		if err == nil {
+			// any reply, even an error, shows the coordinator is reachable
+			_, _ = c.Read("/", false)
+		}
+		done <- dialed{c, err}
+	}()
+	select {
+	case d := <-done:
+		if d.err != nil {
+			return nil, errors.Annotatef(d.err, "connect %s %s", coordinatorType, addr)
+		}
+		return d.c, nil
+	case <-time.After(dialTimeout):
+		go func() {
+			if d := <-done; d.c != nil {
+				d.c.Close()
+			}
+		}()
+		return nil, errors.Errorf("connect %s %s: no answer within %v", coordinatorType, addr, dialTimeout)
+	}
+}
+
+// openCluster connects to another product for `slot migrate --to-product`.
+// Without a config file the product is reached through the coordinator of
+// this cli and its data nodes share the datanode_* settings.
+func openCluster(product, configFile string) (*pkgcli.Cluster, error) {
+	if configFile == "" {
+		return &pkgcli.Cluster{
+			Product:  product,
+			Store:    models.NewStore(store.Client(), product),
+			SlotNum:  slotNum,
+			DataNode: readDataNodeConfig(config),
+			Lock:     lockClient,
+			Shared:   true,
+		}, nil
+	}
+	conf, err := utils.InitConfigFromFile(configFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c, lc, err := newCoordinatorClient(conf, nil)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := conf.ReadInt("slot_num", 128)
+	return &pkgcli.Cluster{
+		Product:  product,
+		Store:    models.NewStore(pkgcli.InstrumentClient(c), product),
+		SlotNum:  n,
+		DataNode: readDataNodeConfig(conf),
+		Lock:     lc,
+	}, nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/c4pt0r/cfg"
+)
+
+func TestCoordinatorTLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    map[string]string
+		addr    string
+		wantTLS bool
+		wantErr string
+	}{
+		{name: "plain", addr: "10.0.0.1:2379"},
+		{name: "https endpoint", addr: "https://10.0.0.1:2379", wantTLS: true},
+		{name: "skip verify", conf: map[string]string{"coordinator_tls_skip_verify": "true"}, addr: "10.0.0.1:2379", wantTLS: true},
+		{name: "server name", conf: map[string]string{"coordinator_tls_server_name": "etcd"}, addr: "10.0.0.1:2379", wantTLS: true},
+		{name: "missing ca", conf: map[string]string{"coordinator_tls_ca": "/nonexistent/ca.pem"}, addr: "10.0.0.1:2379", wantErr: "read ca"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := cfg.NewCfg("")
+			for k, v := range tt.conf {
+				conf.WriteString(k, v)
+			}
+			c, err := coordinatorTLS(conf, nil, tt.addr)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (c != nil) != tt.wantTLS {
+				t.Errorf("tls = %v, want %v", c != nil, tt.wantTLS)
+			}
+		})
+	}
+}
+
+func TestCoordinatorTLSOnlyEtcd(t *testing.T) {
+	for _, typ := range []string{"zookeeper", "etcdv2"} {
+		conf := cfg.NewCfg("")
+		conf.WriteString("coordinator_type", typ)
+		conf.WriteString("coordinator_tls_skip_verify", "true")
+		_, _, err := newCoordinatorClient(conf, nil)
+		if err == nil || !strings.Contains(err.Error(), "only supported with coordinator_type=etcd") {
+			t.Errorf("%s: err = %v", typ, err)
+		}
+	}
+}
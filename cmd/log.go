@@ -0,0 +1,142 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+	kitlog "github.com/IceFireDB/kit/pkg/logger"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	defaultLogMaxSize    = 100 // MB
+	defaultLogMaxBackups = 5
+)
+
+// initLogger re-initializes the global logger from the log-* flags. It must
+// run after flags are parsed, so it is called from app.Before.
+func initLogger(ctx *cli.Context) error {
+	level := ctx.String("log-level")
+	if ctx.Bool("verbose") {
+		level = string(log.DebugLevel)
+	}
+	if level == "" {
+		level = string(log.InfoLevel)
+	}
+	var json bool
+	switch format := ctx.String("log-format"); format {
+	case "", "text":
+	case "json":
+		json = true
+	default:
+		return errors.Errorf("invalid log format %q, should be text or json", format)
+	}
+
+	// the kit models log through the kit logger, which only writes to
+	// stdout
+	kitlog.Init("kit", kitlog.WithOutputLevelString(level), kitlog.WithOutputFormat(json))
+
+	opts := []log.Option{
+		log.WithOutputLevelString(level),
+		log.WithOutputFormat(json),
+	}
+
+	name := ctx.String("log-file")
+	if name == "" {
+		return log.Init("cli", opts...)
+	}
+
+	w, err := openRotatingWriter(name, int64(ctx.Int("log-max-size"))*1024*1024, ctx.Int("log-max-backups"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return log.Init("cli", append(opts, log.WithOutput(w))...)
+}
+
+// rotatingWriter appends to a log file and rotates it before a write would
+// grow it beyond maxSize, keeping at most maxBackups old files.
+type rotatingWriter struct {
+	name       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingWriter(name string, maxSize int64, maxBackups int) (*rotatingWriter, error) {
+	w := &rotatingWriter{name: name, maxSize: maxSize, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	f, err := os.OpenFile(w.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, fi.Size()
+	return nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			// keep logging to the current file rather than losing lines
+			fmt.Fprintf(os.Stderr, "rotate log file %s: %v\n", w.name, err)
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingWriter) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	if err := shiftLogFiles(w.name, w.maxBackups); err != nil {
+		// reopen what is left so that the next write does not fail
+		if e := w.open(); e != nil {
+			return e
+		}
+		return err
+	}
+	return w.open()
+}
+
+// shiftLogFiles shifts name to name.1, name.1 to name.2 and so on, keeping
+// at most maxBackups old files.
+func shiftLogFiles(name string, maxBackups int) error {
+	if maxBackups <= 0 {
+		return os.Remove(name)
+	}
+
+	_ = os.Remove(fmt.Sprintf("%s.%d", name, maxBackups))
+	for i := maxBackups - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", name, i)
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", name, i+1)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(name, name+".1")
+}
@@ -0,0 +1,57 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+func TestWithOutput(t *testing.T) {
+	defer log.Init("cli", log.WithOutputLevelString("error"))
+	var buf bytes.Buffer
+	if err := log.Init("cli", log.WithOutputLevelString("info"), log.WithOutput(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	log.Info("to the writer")
+	if !strings.Contains(buf.String(), "to the writer") {
+		t.Errorf("writer got %q", buf.String())
+	}
+}
+
+func TestRotatingWriter(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "cli.log")
+	w, err := openRotatingWriter(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every line but the first rotates
+	for _, line := range []string{"line1 ab\n", "line2 ab\n", "line3 ab\n", "line4 ab\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, want := range map[string]string{
+		name:        "line4 ab\n",
+		name + ".1": "line3 ab\n",
+		name + ".2": "line2 ab\n",
+	} {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s holds %q, want %q", filepath.Base(file), b, want)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than 2 backups kept")
+	}
+}
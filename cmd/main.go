@@ -5,10 +5,10 @@ package main
 
 import (
 	"flag"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	pkgcli "github.com/IceFireDB/cli/pkg/cli"
 	"github.com/IceFireDB/kit/pkg/models"
@@ -19,7 +19,8 @@ import (
 	"github.com/ledisdb/xcodis/utils"
 	_ "net/http/pprof"
 
-	log "github.com/IceFireDB/kit/pkg/logger"
+	log "github.com/IceFireDB/cli/pkg/log"
+	kitlog "github.com/IceFireDB/kit/pkg/logger"
 	"github.com/c4pt0r/cfg"
 	"github.com/juju/errors"
 )
@@ -35,9 +36,12 @@ var (
 	productName string
 	config      *cfg.Cfg
 	livingNode  string
-	broker      = "ledisdb"
-	slotNum     = 128
-	store       *models.Store
+	// stops the session heartbeat
+	stopHeartbeat func()
+	broker        = "ledisdb"
+	slotNum       = 128
+	store         *models.Store
+	lockClient    pkgcli.LockClient
 )
 
 type Command struct {
@@ -50,25 +54,63 @@ type Command struct {
 }
 
 func registerConfigNode() error {
-	lock := models.NewLock()
-
-	err := store.RegisterActiveCli(lock)
+	name, stop, err := pkgcli.RegisterSession(store, os.Args[1:])
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	livingNode = lock.Name()
+	livingNode = name
+	stopHeartbeat = stop
 
 	return nil
 }
 
 func unRegisterConfigNode() {
 	log.Debugf("unRegisterConfigNode %s", livingNode)
+	// a heartbeat after the delete would register the session again
+	if stopHeartbeat != nil {
+		stopHeartbeat()
+	}
 	if len(livingNode) > 0 {
 		_ = store.UnregisterActiveCli(livingNode)
 	}
 }
 
+// readDataNodeConfig reads the credentials and TLS settings of the data
+// nodes from conf, e.g.
+//
+//	datanode_user=cli
+//	datanode_password=secret
+//	datanode_tls=true
+//	datanode_tls_ca=/etc/icefiredb/ca.pem
+func readDataNodeConfig(conf *cfg.Cfg) *pkgcli.DataNodeConfig {
+	c := &pkgcli.DataNodeConfig{}
+	c.User, _ = conf.ReadString("datanode_user", "")
+	c.Password, _ = conf.ReadString("datanode_password", "")
+	migrateAuth, _ := conf.ReadString("datanode_migrate_auth", "false")
+	c.MigrateAuth = migrateAuth == "true"
+	tlsOn, _ := conf.ReadString("datanode_tls", "false")
+	c.TLS = tlsOn == "true"
+	c.CAFile, _ = conf.ReadString("datanode_tls_ca", "")
+	c.CertFile, _ = conf.ReadString("datanode_tls_cert", "")
+	c.KeyFile, _ = conf.ReadString("datanode_tls_key", "")
+	c.ServerName, _ = conf.ReadString("datanode_tls_server_name", "")
+	skipVerify, _ := conf.ReadString("datanode_tls_skip_verify", "false")
+	c.SkipVerify = skipVerify == "true"
+	return c
+}
+
+// serveMetrics exposes /debug/pprof and /metrics until the cli exits.
+func serveMetrics(addr string) {
+	http.Handle("/metrics", pkgcli.MetricsHandler())
+	go func() {
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			log.Errorf("serve metrics on %s failed: %v", addr, err)
+		}
+	}()
+	log.Infof("serving pprof and metrics on %s", addr)
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "pd"
@@ -88,9 +130,33 @@ func main() {
 		&cli.StringFlag{
 			Name:     "log-level",
 			Aliases:  []string{"l"},
-			Usage:    "log level",
+			Usage:    "log level (debug, info, warn, error, fatal)",
 			Required: false,
 		},
+		&cli.StringFlag{
+			Name:  "log-format",
+			Usage: "log format (text, json)",
+			Value: "text",
+		},
+		&cli.IntFlag{
+			Name:  "log-max-size",
+			Usage: "rotate the log file before it grows larger than this many MB, 0 to disable",
+			Value: defaultLogMaxSize,
+		},
+		&cli.IntFlag{
+			Name:  "log-max-backups",
+			Usage: "number of rotated log files to keep",
+			Value: defaultLogMaxBackups,
+		},
+		&cli.BoolFlag{
+			Name:    "verbose",
+			Aliases: []string{"v"},
+			Usage:   "shortcut for --log-level debug",
+		},
+		&cli.StringFlag{
+			Name:  "metrics-addr",
+			Usage: "serve pprof and prometheus metrics on this address, e.g. :9090",
+		},
 		&cli.StringFlag{
 			Name: "broker",
 		},
@@ -98,34 +164,39 @@ func main() {
 			Name: "slot-num",
 		},
 	}
-	app.Commands = []*cli.Command{pkgcli.NewSlotCmd(), pkgcli.NewGroupCmd()}
+	app.Flags = append(app.Flags, coordinatorFlags...)
+	app.Commands = []*cli.Command{pkgcli.NewSlotCmd(), pkgcli.NewGroupCmd(), pkgcli.NewAuditCmd(), pkgcli.NewKeyCmd(), pkgcli.NewPlanCmd(), pkgcli.NewApplyCmd(),
+		pkgcli.NewSessionCmd(), pkgcli.NewLockCmd()}
 	app.Before = func(ctx *cli.Context) (err error) {
 
+		if err := initLogger(ctx); err != nil {
+			return err
+		}
+		if addr := ctx.String("metrics-addr"); addr != "" {
+			serveMetrics(addr)
+		}
+
 		configFile := ctx.String("config")
 		config, err = utils.InitConfigFromFile(configFile)
 		if err != nil {
 			panic(err)
 		}
-		//if logfile := ctx.String("log-file"); logfile != "" {
-		//	log.SetOutputByName(ctx.String("log-file"))
-		//}
-		//if logLevel := ctx.String("log-file"); logLevel != "" {
-		//	log.SetLevelByString(logLevel)
-		//}
-
-		coordinatorType, _ := config.ReadString("coordinator_type", "etcd")
-		coordinatorAddr, _ := config.ReadString("coordinator_addr", "localhost:2379")
+
 		productName, _ = config.ReadString("product", "test")
 		ctx.Context = context.WithValue(ctx.Context, "product", productName)
-		client, err := models.NewClient(coordinatorType, coordinatorAddr, "", time.Second*5)
+		client, lc, err := newCoordinatorClient(config, ctx)
 		if err != nil {
 			panic(err)
 		}
-		store = models.NewStore(client, productName)
+		store = models.NewStore(pkgcli.InstrumentClient(client), productName)
+		lockClient = lc
 		ctx.Context = context.WithValue(ctx.Context, "store", store)
+		ctx.Context = context.WithValue(ctx.Context, "lockClient", lockClient)
 		broker, _ = config.ReadString("broker", "redis")
 		slotNum, _ = config.ReadInt("slot_num", 128)
 		ctx.Context = context.WithValue(ctx.Context, "slotNum", slotNum)
+		ctx.Context = context.WithValue(ctx.Context, "dataNode", readDataNodeConfig(config))
+		ctx.Context = context.WithValue(ctx.Context, "openCluster", pkgcli.ClusterOpener(openCluster))
 
 		log.Debugf("product: %s", productName)
 		log.Debugf("broker: %s", broker)
@@ -133,20 +204,19 @@ func main() {
 		if err := registerConfigNode(); err != nil {
 			log.Fatal(errors.ErrorStack(err))
 		}
-
-		//if err := removeOrphanLocks(); err != nil {
-		//	log.Fatal(errors.ErrorStack(err))
-		//}
+		ctx.Context = context.WithValue(ctx.Context, "livingNode", livingNode)
 
 		return nil
 	}
 
 	log.Init("cli", log.WithOutputLevelString("info"))
+	kitlog.Init("kit", kitlog.WithOutputLevelString("info"))
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	signal.Notify(c, syscall.SIGTERM)
 	go func() {
 		<-c
+		unRegisterConfigNode()
 		os.Exit(0)
 	}()
 
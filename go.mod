@@ -3,6 +3,7 @@ module github.com/IceFireDB/cli
 go 1.16
 
 require (
+	github.com/CodisLabs/codis v0.0.0-20181104082235-de1ad026e329
 	github.com/IceFireDB/kit v0.0.0-20210930080210-c415e3a3b490
 	github.com/c4pt0r/cfg v0.0.0-20150302064018-429e6985f0b0
 	github.com/docopt/docopt-go v0.0.0-20180111231733-ee0de3bc6815
@@ -10,6 +11,12 @@ require (
 	github.com/juju/errors v0.0.0-20210818161939-5560c4c073ff
 	github.com/ledisdb/xcodis v0.0.0-20200426120518-40bcf4cf8a2d
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
+	github.com/prometheus/client_golang v1.11.0
+	github.com/samuel/go-zookeeper v0.0.0-20201211165307-7117e9ea2414
+	github.com/sirupsen/logrus v1.8.1
 	github.com/urfave/cli/v2 v2.3.0
+	go.etcd.io/etcd/client/v2 v2.305.0
+	go.etcd.io/etcd/client/v3 v3.5.0
 	golang.org/x/net v0.0.0-20210913180222-943fd674d43e
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -10,7 +10,7 @@ import (
 	"github.com/juju/errors"
 
 	docopt "github.com/docopt/docopt-go"
-	log "github.com/IceFireDB/kit/pkg/logger"
+	log "github.com/IceFireDB/cli/pkg/log"
 )
 
 func cmdAction(argv []string) (err error) {
@@ -0,0 +1,243 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+const (
+	AUDIT_RESULT_OK    string = "ok"
+	AUDIT_RESULT_ERROR string = "error"
+)
+
+// AuditRecord describes one topology-changing command run by the cli.
+type AuditRecord struct {
+	Ts      int64             `json:"ts"`
+	User    string            `json:"user"`
+	Host    string            `json:"host"`
+	Node    string            `json:"node"`
+	Command string            `json:"command"`
+	Args    []string          `json:"args"`
+	Flags   map[string]string `json:"flags,omitempty"`
+	Before  interface{}       `json:"before"`
+	After   interface{}       `json:"after"`
+	Result  string            `json:"result"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// auditSnapshot returns the part of the topology a command is going to change.
+type auditSnapshot func(c *cli.Context) (interface{}, error)
+
+func auditDir() string {
+	return path.Join(models.ProductDir(productName), "audit")
+}
+
+func NewAuditCmd() *cli.Command {
+	c := &cli.Command{
+		Name: "audit",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "list",
+				Description: "list audit records of topology-changing commands",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "since",
+						Usage: "only show records newer than a duration (e.g. 24h) or a RFC3339 time",
+					},
+				},
+				Action: runAuditList,
+			},
+		},
+		Before: loadContext,
+	}
+	return c
+}
+
+// withAudit wraps a mutating action so that its before/after state and
+// result are appended to the audit log of the product.
+func withAudit(snapshot auditSnapshot, action cli.ActionFunc) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		before := takeAuditSnapshot(c, snapshot)
+		err := action(c)
+		after := takeAuditSnapshot(c, snapshot)
+		if e := writeAuditRecord(newAuditRecord(c, before, after, err)); e != nil {
+			log.Warnf("write audit record failed: %v", e)
+		}
+		return err
+	}
+}
+
+func takeAuditSnapshot(c *cli.Context, snapshot auditSnapshot) interface{} {
+	if snapshot == nil {
+		return nil
+	}
+	v, err := snapshot(c)
+	if err != nil {
+		log.Warnf("audit snapshot failed: %v", err)
+		return nil
+	}
+	return v
+}
+
+func newAuditRecord(c *cli.Context, before, after interface{}, err error) *AuditRecord {
+	r := &AuditRecord{
+		Ts:      time.Now().Unix(),
+		Node:    livingNode,
+		Command: c.Command.FullName(),
+		Args:    c.Args().Slice(),
+		Before:  before,
+		After:   after,
+		Result:  AUDIT_RESULT_OK,
+	}
+	if u, e := user.Current(); e == nil {
+		r.User = u.Username
+	} else {
+		r.User = os.Getenv("USER")
+	}
+	r.Host, _ = os.Hostname()
+	for _, name := range c.LocalFlagNames() {
+		if r.Flags == nil {
+			r.Flags = make(map[string]string)
+		}
+		r.Flags[name] = fmt.Sprint(c.Value(name))
+	}
+	if err != nil {
+		r.Result = AUDIT_RESULT_ERROR
+		r.Error = err.Error()
+	}
+	return r
+}
+
+func writeAuditRecord(r *AuditRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// CreateInOrder shares its sequence with the action dir on etcd, so build
+	// a sortable key from the timestamp and the cli node instead.
+	name := fmt.Sprintf("%019d-%s", time.Now().UnixNano(), r.Node)
+	return errors.Trace(store.Client().Create(path.Join(auditDir(), name), b))
+}
+
+func loadAuditRecords(since int64) ([]*AuditRecord, error) {
+	paths, err := store.Client().List(auditDir(), false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Strings(paths)
+	var records []*AuditRecord
+	for _, p := range paths {
+		b, err := store.Client().Read(p, false)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if b == nil {
+			continue
+		}
+		r := &AuditRecord{}
+		if err := json.Unmarshal(b, r); err != nil {
+			log.Warnf("bad audit record %s: %v", p, err)
+			continue
+		}
+		if r.Ts >= since {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+// parseSince accepts either a duration relative to now or an absolute time.
+func parseSince(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d).Unix(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Unix(), nil
+	}
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	return 0, errors.Errorf("invalid --since %q, should be a duration, RFC3339 time or unix timestamp", s)
+}
+
+func runAuditList(context *cli.Context) error {
+	since, err := parseSince(context.String("since"))
+	if err != nil {
+		return err
+	}
+	records, err := loadAuditRecords(since)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	b, _ := json.MarshalIndent(records, " ", "  ")
+	fmt.Println(string(b))
+	return nil
+}
+
+// slotRangeSnapshot records the slots from the first two args.
+func slotRangeSnapshot(c *cli.Context) (interface{}, error) {
+	from, err := strconv.Atoi(c.Args().Get(0))
+	if err != nil {
+		return nil, err
+	}
+	to, err := strconv.Atoi(c.Args().Get(1))
+	if err != nil {
+		return nil, err
+	}
+	return loadSlots(from, to)
+}
+
+// singleSlotSnapshot records the slot of the first arg.
+func singleSlotSnapshot(c *cli.Context) (interface{}, error) {
+	slotId, err := strconv.Atoi(c.Args().Get(0))
+	if err != nil {
+		return nil, err
+	}
+	return loadSlots(slotId, slotId)
+}
+
+// allSlotsSnapshot records every slot of the product.
+func allSlotsSnapshot(c *cli.Context) (interface{}, error) {
+	return loadSlots(0, slotNum-1)
+}
+
+// groupSnapshot records the server group of the first arg.
+func groupSnapshot(c *cli.Context) (interface{}, error) {
+	groupId, err := strconv.Atoi(c.Args().Get(0))
+	if err != nil {
+		return nil, err
+	}
+	return store.LoadGroup(groupId, false)
+}
+
+func loadSlots(from, to int) ([]*models.Slot, error) {
+	var slots []*models.Slot
+	for i := from; i <= to; i++ {
+		s, err := store.GetSlot(i, false)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if s != nil {
+			slots = append(slots, s)
+		}
+	}
+	return slots, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+)
+
+var ErrAbortedByUser = errors.New("aborted by user")
+
+var yesFlag = &cli.BoolFlag{
+	Name:    "yes",
+	Aliases: []string{"y"},
+	Usage:   "skip the confirmation prompt, required when stdin is not a terminal",
+}
+
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm shows the impact of a destructive command and asks the operator
+// to go on. It returns nil straight away when --yes is given, and refuses to
+// run when there is nobody to ask.
+func confirm(c *cli.Context, impact []string) error {
+	if c.Bool("yes") {
+		return nil
+	}
+	name := c.Command.FullName()
+	if !stdinIsTerminal() {
+		return errors.Errorf("refusing to run %q without --yes, stdin is not a terminal", name)
+	}
+
+	fmt.Fprintf(os.Stderr, "%s will:\n", name)
+	for _, line := range impact {
+		fmt.Fprintf(os.Stderr, "  - %s\n", line)
+	}
+	fmt.Fprint(os.Stderr, "continue? [y/N]: ")
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return ErrAbortedByUser
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return ErrAbortedByUser
+}
+
+// countSlotsByGroup renders "group 1: 64, group 2: 3" for the given slots.
+func countSlotsByGroup(slots []*models.Slot) string {
+	cnt := make(map[int]int)
+	var ids []int
+	for _, s := range slots {
+		if _, ok := cnt[s.GroupId]; !ok {
+			ids = append(ids, s.GroupId)
+		}
+		cnt[s.GroupId]++
+	}
+	sort.Ints(ids)
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, fmt.Sprintf("group %d: %d", id, cnt[id]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func slotInitImpact(slots []*models.Slot) []string {
+	var assigned, migrating []*models.Slot
+	for _, s := range slots {
+		if s.GroupId != models.INVALID_ID {
+			assigned = append(assigned, s)
+		}
+		if s.State.Status == models.SLOT_STATUS_MIGRATE {
+			migrating = append(migrating, s)
+		}
+	}
+	impact := []string{fmt.Sprintf("reset %d slots to offline without group", slotNum)}
+	if len(assigned) > 0 {
+		impact = append(impact, fmt.Sprintf("unassign %d slots (%s)", len(assigned), countSlotsByGroup(assigned)))
+	}
+	if len(migrating) > 0 {
+		impact = append(impact, fmt.Sprintf("drop the state of %d migrating slots", len(migrating)))
+	}
+	return impact
+}
+
+func slotRangeSetImpact(slots []*models.Slot, from, to, groupId int, status models.SlotStatus) []string {
+	impact := []string{fmt.Sprintf("set %d slots [%d, %d] to group %d, status %s", to-from+1, from, to, groupId, status)}
+	var moved, offline, migrating []*models.Slot
+	for _, s := range slots {
+		if s.GroupId != groupId && s.GroupId != models.INVALID_ID {
+			moved = append(moved, s)
+		}
+		if s.State.Status == models.SLOT_STATUS_ONLINE && status != models.SLOT_STATUS_ONLINE {
+			offline = append(offline, s)
+		}
+		if s.State.Status == models.SLOT_STATUS_MIGRATE {
+			migrating = append(migrating, s)
+		}
+	}
+	if len(moved) > 0 {
+		impact = append(impact, fmt.Sprintf("move %d slots away from their group without migrating data (%s)", len(moved), countSlotsByGroup(moved)))
+	}
+	if len(offline) > 0 {
+		impact = append(impact, fmt.Sprintf("take %d online slots %s", len(offline), status))
+	}
+	if len(migrating) > 0 {
+		impact = append(impact, fmt.Sprintf("interrupt %d migrating slots", len(migrating)))
+	}
+	return impact
+}
+
+func removeGroupImpact(sg *models.ServerGroup, slots []models.Slot) []string {
+	impact := []string{fmt.Sprintf("delete group %d", sg.Id)}
+	for _, s := range sg.Servers {
+		impact = append(impact, fmt.Sprintf("delete server %s (%s)", s.Addr, s.Type))
+	}
+	var owned int
+	for _, s := range slots {
+		if s.GroupId == sg.Id {
+			owned++
+		}
+	}
+	if owned > 0 {
+		impact = append(impact, fmt.Sprintf("leave %d slots pointing to the deleted group", owned))
+	}
+	return impact
+}
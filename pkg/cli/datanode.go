@@ -0,0 +1,210 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/IceFireDB/kit/pkg/router"
+	"github.com/garyburd/redigo/redis"
+	"github.com/juju/errors"
+)
+
+// data types stored by a data node, in the order migratedb walks them
+var dataTypes = []string{"KV", "HASH", "LIST", "SET", "ZSET"}
+
+const scanCount = 1000
+
+// dialServer opens a connection to a data node, authenticated and over TLS
+// as configured.
+func dialServer(addr string) (redis.Conn, error) {
+	return dialServerWith(dataNode, addr)
+}
+
+// dialServerWith opens a connection to a data node with the settings of
+// another product.
+func dialServerWith(dn *DataNodeConfig, addr string) (redis.Conn, error) {
+	if dn == nil {
+		c, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, errors.Annotatef(err, "dial %s", addr)
+		}
+		return c, nil
+	}
+	c, err := redis.Dial("tcp", addr, dn.dialOptions()...)
+	if err != nil {
+		return nil, errors.Annotatef(err, "dial %s", addr)
+	}
+	if err := dn.auth(c); err != nil {
+		c.Close()
+		return nil, errors.Annotatef(err, "auth %s", addr)
+	}
+	return c, nil
+}
+
+// scanKeys walks every key of one data type on a data node.
+func scanKeys(c redis.Conn, dataType string, fn func(key []byte) error) error {
+	return scanKeyBatches(c, dataType, func(keys [][]byte) error {
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scanKeyBatches walks every key of one data type on a data node, one xscan
+// reply at a time.
+func scanKeyBatches(c redis.Conn, dataType string, fn func(keys [][]byte) error) error {
+	cursor := []byte("")
+	for {
+		reply, err := redis.Values(c.Do("xscan", dataType, cursor, "count", scanCount))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(reply) != 2 {
+			return errors.Errorf("bad xscan reply %v", reply)
+		}
+		cursor, err = redis.Bytes(reply[0], nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		keys, err := redis.ByteSlices(reply[1], nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if len(cursor) == 0 || string(cursor) == "0" {
+			return nil
+		}
+	}
+}
+
+// scanSlotKeys walks the keys of one data type that hash to slotId.
+func scanSlotKeys(c redis.Conn, dataType string, slotId int, fn func(key []byte) error) error {
+	return scanKeys(c, dataType, func(key []byte) error {
+		if router.MapKey2Slot(key, slotNum) != slotId {
+			return nil
+		}
+		return fn(key)
+	})
+}
+
+// countSlotKeys returns the number of keys per data type for each of the
+// given slots, walking the keyspace of the data node once.
+func countSlotKeys(c redis.Conn, slots []int) (map[int]map[string]int64, error) {
+	ret := make(map[int]map[string]int64, len(slots))
+	for _, s := range slots {
+		ret[s] = make(map[string]int64, len(dataTypes))
+	}
+	for _, tp := range dataTypes {
+		err := scanKeys(c, tp, func(key []byte) error {
+			if cnt, ok := ret[router.MapKey2Slot(key, slotNum)]; ok {
+				cnt[tp]++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func sumKeys(cnt map[string]int64) int64 {
+	var n int64
+	for _, v := range cnt {
+		n += v
+	}
+	return n
+}
+
+// loadGroupMaster returns the master server of a group.
+func loadGroupMaster(groupId int) (*models.Server, error) {
+	g, err := store.LoadGroup(groupId, true)
+	if err != nil {
+		return nil, errors.Annotatef(err, "load group %d", groupId)
+	}
+	m, err := store.Master(g)
+	if err != nil {
+		return nil, errors.Annotatef(err, "group %d", groupId)
+	}
+	return m, nil
+}
+
+// commands to probe a key of each data type
+type dataTypeCmds struct {
+	exists string
+	size   string
+	ttl    string
+	// serializes the value for restore
+	dump  string
+	clear string
+}
+
+var typeCmds = map[string]dataTypeCmds{
+	"KV":   {"exists", "strlen", "ttl", "dump", "del"},
+	"HASH": {"hkeyexists", "hlen", "httl", "hdump", "hclear"},
+	"LIST": {"lkeyexists", "llen", "lttl", "ldump", "lclear"},
+	"SET":  {"skeyexists", "scard", "sttl", "sdump", "sclear"},
+	"ZSET": {"zkeyexists", "zcard", "zttl", "zdump", "zclear"},
+}
+
+// KeyInfo describes a key of one data type on a data node. Size is the
+// value length for KV and the number of elements otherwise.
+type KeyInfo struct {
+	Type string `json:"type"`
+	TTL  int64  `json:"ttl"`
+	Size int64  `json:"size"`
+}
+
+// inspectKey returns the key under every data type it exists in.
+func inspectKey(c redis.Conn, key []byte) ([]KeyInfo, error) {
+	var infos []KeyInfo
+	for _, tp := range dataTypes {
+		cmds := typeCmds[tp]
+		n, err := redis.Int(c.Do(cmds.exists, key))
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s %s", cmds.exists, key)
+		}
+		if n == 0 {
+			continue
+		}
+		info := KeyInfo{Type: tp}
+		if info.Size, err = redis.Int64(c.Do(cmds.size, key)); err != nil {
+			return nil, errors.Annotatef(err, "%s %s", cmds.size, key)
+		}
+		if info.TTL, err = redis.Int64(c.Do(cmds.ttl, key)); err != nil {
+			return nil, errors.Annotatef(err, "%s %s", cmds.ttl, key)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// keySizes returns the size command result of each key, pipelined.
+func keySizes(c redis.Conn, dataType string, keys [][]byte) ([]int64, error) {
+	cmd := typeCmds[dataType].size
+	for _, key := range keys {
+		if err := c.Send(cmd, key); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	sizes := make([]int64, 0, len(keys))
+	for range keys {
+		n, err := redis.Int64(c.Receive())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/juju/errors"
+)
+
+// DataNodeConfig holds the credentials and TLS settings used for every
+// connection to a data node, read from the datanode_* config keys.
+type DataNodeConfig struct {
+	User     string
+	Password string
+	// forward the credentials to migratedb, only for data nodes whose
+	// migratedb accepts AUTH / AUTH2 after the 6 standard arguments
+	MigrateAuth bool
+
+	TLS        bool
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	SkipVerify bool
+
+	tlsConfig *tls.Config
+}
+
+// dataNode is set up by loadContext, nil means plain connections.
+var dataNode *DataNodeConfig
+
+// init loads the TLS files once so that a bad path fails before any
+// command runs.
+func (c *DataNodeConfig) init() error {
+	if !c.TLS {
+		if c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" {
+			return errors.New("datanode_tls_* files are set but datanode_tls is off")
+		}
+		return nil
+	}
+	cfg, err := LoadTLSConfig(c.CAFile, c.CertFile, c.KeyFile, c.ServerName, c.SkipVerify)
+	if err != nil {
+		return errors.Annotatef(err, "datanode tls")
+	}
+	c.tlsConfig = cfg
+	return nil
+}
+
+// LoadTLSConfig builds a client TLS config, the CA and the client
+// certificate are optional.
+func LoadTLSConfig(caFile, certFile, keyFile, serverName string, skipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: skipVerify,
+	}
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Annotatef(err, "read ca")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("no certificate found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Annotatef(err, "load client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func (c *DataNodeConfig) dialOptions() []redis.DialOption {
+	var opts []redis.DialOption
+	if c.TLS {
+		opts = append(opts,
+			redis.DialUseTLS(true),
+			redis.DialTLSConfig(c.tlsConfig),
+			redis.DialTLSSkipVerify(c.SkipVerify))
+	}
+	// redigo only knows the legacy AUTH, ACL users are sent by auth()
+	if c.Password != "" && c.User == "" {
+		opts = append(opts, redis.DialPassword(c.Password))
+	}
+	return opts
+}
+
+// auth authenticates a new connection as an ACL user.
+func (c *DataNodeConfig) auth(conn redis.Conn) error {
+	if c.User == "" || c.Password == "" {
+		return nil
+	}
+	_, err := conn.Do("AUTH", c.User, c.Password)
+	return errors.Trace(err)
+}
+
+// migrateAuthArgs are appended to migratedb / migrate so that the source
+// can log in to the target, in the syntax of the redis MIGRATE command.
+// Ledis xmigratedb takes exactly 6 arguments, so they are only added with
+// datanode_migrate_auth.
+func (c *DataNodeConfig) migrateAuthArgs() []interface{} {
+	switch {
+	case c == nil || !c.MigrateAuth || c.Password == "":
+		return nil
+	case c.User != "":
+		return []interface{}{"AUTH2", c.User, c.Password}
+	}
+	return []interface{}{"AUTH", c.Password}
+}
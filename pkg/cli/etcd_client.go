@@ -0,0 +1,267 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+	"github.com/IceFireDB/kit/pkg/models/client"
+	"github.com/juju/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	ErrEtcdClientClosed = errors.New("use of closed etcd client")
+	ErrEtcdNotDir       = errors.New("etcd: not a dir")
+	ErrEtcdNotFile      = errors.New("etcd: not a file")
+)
+
+// etcdEndpoints adds the scheme to the endpoints that have none, https
+// when TLS is on.
+func etcdEndpoints(addr string, useTLS bool) []string {
+	scheme := "http://"
+	if useTLS {
+		scheme = "https://"
+	}
+	var endpoints []string
+	for _, e := range strings.Split(addr, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, "http://") && !strings.HasPrefix(e, "https://") {
+			e = scheme + e
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints
+}
+
+// DialEtcd connects to etcd v3 and waits up to dialTimeout for a first
+// answer, tlsConfig nil connects in plain text.
+func DialEtcd(addr, user, password string, tlsConfig *tls.Config, dialTimeout time.Duration) (*clientv3.Client, error) {
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   etcdEndpoints(addr, tlsConfig != nil),
+		DialTimeout: dialTimeout,
+		Username:    user,
+		Password:    password,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "connect etcd %s", addr)
+	}
+	cntx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	if _, err := c.Get(cntx, "/", clientv3.WithKeysOnly()); err != nil {
+		c.Close()
+		return nil, errors.Annotatef(err, "connect etcd %s", addr)
+	}
+	return c, nil
+}
+
+// EtcdClient is the coordinator client for etcd v3. It behaves as the kit
+// etcd client but runs on a connection set up by the cli, which carries
+// the TLS settings and is shared with the lock client.
+type EtcdClient struct {
+	sync.Mutex
+	client *clientv3.Client
+
+	closed  bool
+	timeout time.Duration
+	lastKey int
+
+	cancel  context.CancelFunc
+	context context.Context
+}
+
+func NewEtcdClient(c *clientv3.Client, timeout time.Duration) *EtcdClient {
+	ec := &EtcdClient{client: c, timeout: timeout}
+	ec.context, ec.cancel = context.WithCancel(context.Background())
+	return ec
+}
+
+func (c *EtcdClient) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.cancel()
+	return errors.Trace(c.client.Close())
+}
+
+func (c *EtcdClient) newContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.context, c.timeout)
+}
+
+func (c *EtcdClient) put(path string, data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return errors.Trace(ErrEtcdClientClosed)
+	}
+	cntx, cancel := c.newContext()
+	defer cancel()
+	log.Debugf("etcd put node %s", path)
+	if _, err := c.client.Put(cntx, path, string(data)); err != nil {
+		log.Debugf("etcd put node %s failed: %s", path, err)
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Create overwrites an existing node as the kit client does, the product
+// lock goes through the lock client instead.
+func (c *EtcdClient) Create(path string, data []byte) error {
+	return c.put(path, data)
+}
+
+func (c *EtcdClient) Update(path string, data []byte) error {
+	return c.put(path, data)
+}
+
+func (c *EtcdClient) Delete(path string) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return errors.Trace(ErrEtcdClientClosed)
+	}
+	cntx, cancel := c.newContext()
+	defer cancel()
+	log.Debugf("etcd delete node %s", path)
+	if _, err := c.client.Delete(cntx, path); err != nil {
+		log.Debugf("etcd delete node %s failed: %s", path, err)
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (c *EtcdClient) Read(path string, must bool) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil, errors.Trace(ErrEtcdClientClosed)
+	}
+	cntx, cancel := c.newContext()
+	defer cancel()
+	r, err := c.client.Get(cntx, path)
+	switch {
+	case err != nil:
+		log.Debugf("etcd read node %s failed: %s", path, err)
+		return nil, errors.Trace(err)
+	case r.Count == 1:
+		return r.Kvs[0].Value, nil
+	case r.Count == 0 && !must:
+		return nil, nil
+	}
+	return nil, errors.Trace(ErrEtcdNotFile)
+}
+
+func (c *EtcdClient) List(path string, must bool) ([]string, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil, errors.Trace(ErrEtcdClientClosed)
+	}
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	cntx, cancel := c.newContext()
+	defer cancel()
+	r, err := c.client.Get(cntx, path, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	switch {
+	case err != nil:
+		log.Debugf("etcd list node %s failed: %s", path, err)
+		return nil, errors.Trace(err)
+	case r.Count == 0:
+		if !must {
+			return nil, nil
+		}
+		return nil, errors.Trace(ErrEtcdNotDir)
+	}
+	paths := make([]string, 0, r.Count)
+	for _, kv := range r.Kvs {
+		paths = append(paths, string(kv.Key))
+	}
+	return paths, nil
+}
+
+// CreateInOrder numbers the children of path, like the kit client it
+// expects the caller to hold the product lock.
+func (c *EtcdClient) CreateInOrder(path string, data []byte) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return "", errors.Trace(ErrEtcdClientClosed)
+	}
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	cntx, cancel := c.newContext()
+	defer cancel()
+	if c.lastKey == 0 {
+		opts := append([]clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithKeysOnly()}, clientv3.WithLastKey()...)
+		last, err := c.client.Get(cntx, path, opts...)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if last.Count != 0 {
+			key := string(last.Kvs[0].Key)
+			if c.lastKey, err = strconv.Atoi(key[strings.LastIndex(key, "/")+1:]); err != nil {
+				return "", errors.Annotatef(err, "parse key %s", key)
+			}
+		}
+	}
+	c.lastKey++
+	path += fmt.Sprintf("%06d", c.lastKey)
+	if _, err := c.client.Put(cntx, path, string(data)); err != nil {
+		return "", errors.Trace(err)
+	}
+	return path, nil
+}
+
+func (c *EtcdClient) WatchInOrder(path string) (<-chan client.Event, []string, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil, nil, errors.Trace(ErrEtcdClientClosed)
+	}
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	cntx, cancel := c.newContext()
+	defer cancel()
+	r, err := c.client.Get(cntx, path, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	var paths []string
+	for _, kv := range r.Kvs {
+		paths = append(paths, string(kv.Key))
+	}
+	signal := make(chan client.Event, 1)
+	go func() {
+		et := client.EventNotWatching
+		cntx, cancel := context.WithCancel(c.context)
+		defer func() {
+			cancel()
+			signal <- client.Event{Type: et}
+			close(signal)
+		}()
+		for r := range c.client.Watch(cntx, path, clientv3.WithPrefix(), clientv3.WithFilterDelete()) {
+			if !r.Created {
+				et = client.EventNodeChildrenChanged
+				return
+			}
+		}
+	}()
+	return signal, paths, nil
+}
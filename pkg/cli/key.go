@@ -0,0 +1,147 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/IceFireDB/kit/pkg/router"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// KeySlotInfo tells which slot, group and data node own a key.
+type KeySlotInfo struct {
+	Key         string                    `json:"key"`
+	SlotId      int                       `json:"slot"`
+	GroupId     int                       `json:"group_id"`
+	Status      models.SlotStatus         `json:"status"`
+	Master      string                    `json:"master,omitempty"`
+	Migrate     *models.SlotMigrateStatus `json:"migrate,omitempty"`
+	MasterError string                    `json:"master_error,omitempty"`
+}
+
+// KeyNodeInfo is a key as found on one data node.
+type KeyNodeInfo struct {
+	GroupId int       `json:"group_id"`
+	Addr    string    `json:"addr"`
+	Types   []KeyInfo `json:"types"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func NewKeyCmd() *cli.Command {
+	c := &cli.Command{
+		Name: "key",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "slot",
+				Description: "slot <key>..., show the slot, group and master owning the keys",
+				Action:      runKeySlot,
+			},
+			{
+				Name:        "get",
+				Description: "get <key>, show type, ttl and size of a key from its owning data node",
+				Action:      runKeyGet,
+			},
+		},
+		Before: loadSlotContext,
+	}
+	return c
+}
+
+func lookupKeySlot(key string) (*KeySlotInfo, error) {
+	slotId := router.MapKey2Slot([]byte(key), slotNum)
+	s, err := store.GetSlot(slotId, true)
+	if err != nil {
+		return nil, errors.Annotatef(err, "load slot %d", slotId)
+	}
+	info := &KeySlotInfo{
+		Key:     key,
+		SlotId:  slotId,
+		GroupId: s.GroupId,
+		Status:  s.State.Status,
+	}
+	if s.State.Status == models.SLOT_STATUS_MIGRATE {
+		info.Migrate = &s.State.MigrateStatus
+	}
+	if s.GroupId != models.INVALID_ID {
+		if m, err := loadGroupMaster(s.GroupId); err != nil {
+			info.MasterError = err.Error()
+		} else {
+			info.Master = m.Addr
+		}
+	}
+	return info, nil
+}
+
+func runKeySlot(context *cli.Context) error {
+	if context.NArg() == 0 {
+		return errors.New("at least one key is required")
+	}
+	infos := make([]*KeySlotInfo, 0, context.NArg())
+	for _, key := range context.Args().Slice() {
+		info, err := lookupKeySlot(key)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, info)
+	}
+	b, _ := json.MarshalIndent(infos, " ", "  ")
+	fmt.Println(string(b))
+	return nil
+}
+
+func inspectKeyOnGroup(groupId int, key string) *KeyNodeInfo {
+	info := &KeyNodeInfo{GroupId: groupId}
+	m, err := loadGroupMaster(groupId)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Addr = m.Addr
+	c, err := dialServer(m.Addr)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	defer c.Close()
+	if info.Types, err = inspectKey(c, []byte(key)); err != nil {
+		info.Error = err.Error()
+	}
+	return info
+}
+
+func runKeyGet(context *cli.Context) error {
+	key := context.Args().Get(0)
+	if key == "" {
+		return errors.New("key is required")
+	}
+	info, err := lookupKeySlot(key)
+	if err != nil {
+		return err
+	}
+
+	// while migrating the key may still be on the source group or already
+	// moved to the target group, look at both
+	groups := []int{info.GroupId}
+	if info.Migrate != nil {
+		groups = []int{info.Migrate.To, info.Migrate.From}
+	}
+	if info.GroupId == models.INVALID_ID && info.Migrate == nil {
+		return errors.Errorf("slot %d of key %q is not assigned to any group", info.SlotId, key)
+	}
+	nodes := make([]*KeyNodeInfo, 0, len(groups))
+	for _, g := range groups {
+		nodes = append(nodes, inspectKeyOnGroup(g, key))
+	}
+
+	b, _ := json.MarshalIndent(struct {
+		*KeySlotInfo
+		Nodes []*KeyNodeInfo `json:"nodes"`
+	}{info, nodes}, " ", "  ")
+	fmt.Println(string(b))
+	return nil
+}
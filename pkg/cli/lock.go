@@ -0,0 +1,342 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+const (
+	defaultLockWait  = 5 * time.Minute
+	defaultLockLease = 30 * time.Second
+	// how often the lock is checked and the wait reported
+	lockPollInterval    = time.Second
+	lockMessageInterval = 10 * time.Second
+)
+
+var (
+	// how long to wait for a lock held by another cli
+	lockWait = defaultLockWait
+	// fail at once when the lock is held
+	lockNoWait = false
+)
+
+var lockFlags = []cli.Flag{
+	&cli.DurationFlag{
+		Name:  "lock-wait",
+		Usage: "how long to wait for the product lock held by another cli",
+		Value: defaultLockWait,
+	},
+	&cli.BoolFlag{
+		Name:  "no-wait",
+		Usage: "fail at once when the product lock is held by another cli",
+	},
+}
+
+func setLockWait(c *cli.Context) error {
+	if d := c.Duration("lock-wait"); d < 0 {
+		return errors.Errorf("invalid lock wait %v", d)
+	}
+	lockWait = c.Duration("lock-wait")
+	lockNoWait = c.Bool("no-wait")
+	return nil
+}
+
+// ProductLock is the record at the lock path. It extends models.Lock with a
+// lease the holder renews, the lock is free once the lease expired.
+type ProductLock struct {
+	Hostname   string `json:"hostname"`
+	Pid        int    `json:"pid"`
+	AcquiredAt int64  `json:"acquired_at,omitempty"`
+	Renewed    int64  `json:"renewed,omitempty"`
+	Lease      int64  `json:"lease,omitempty"`
+}
+
+func newProductLock() *ProductLock {
+	l := models.NewLock()
+	now := time.Now().Unix()
+	return &ProductLock{
+		Hostname:   l.Hostname,
+		Pid:        l.Pid,
+		AcquiredAt: now,
+		Renewed:    now,
+		Lease:      int64(defaultLockLease / time.Second),
+	}
+}
+
+func (l *ProductLock) Name() string {
+	return (&models.Lock{Hostname: l.Hostname, Pid: l.Pid}).Name()
+}
+
+// LockStatus is who holds the product lock taken by migrations, together
+// with the state of the holder's session.
+type LockStatus struct {
+	Held bool `json:"held"`
+	*ProductLock
+	Holder       string `json:"holder,omitempty"`
+	SessionState string `json:"session_state,omitempty"`
+	Command      string `json:"command,omitempty"`
+	StartAt      int64  `json:"start_at,omitempty"`
+	// a stale lock is left by a cli that is gone and may be taken over
+	Stale  bool   `json:"stale,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// the record as read, a takeover swaps exactly this one
+	data []byte
+}
+
+func (st *LockStatus) String() string {
+	s := fmt.Sprintf("%s (host %s, pid %d", st.Holder, st.Hostname, st.Pid)
+	if st.AcquiredAt != 0 {
+		s += ", since " + formatUnix(st.AcquiredAt)
+	}
+	if st.Command != "" {
+		s += ", command: " + st.Command
+	}
+	return s + ")"
+}
+
+func loadLockStatus() (*LockStatus, error) {
+	return loadLockStatusIn(store)
+}
+
+func loadLockStatusIn(st *models.Store) (*LockStatus, error) {
+	b, err := st.Client().Read(st.LockPath(), false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if b == nil {
+		return &LockStatus{}, nil
+	}
+	l := &ProductLock{}
+	if err := json.Unmarshal(b, l); err != nil {
+		return nil, errors.Annotatef(err, "decode lock %s", st.LockPath())
+	}
+	ls := &LockStatus{Held: true, ProductLock: l, Holder: l.Name(), data: b}
+
+	now := time.Now()
+	s, err := loadSession(st, l.Name())
+	switch {
+	case errors.IsNotFound(err) && l.Lease > 0:
+		// e.g. a cli migrating slots into this product, its session is
+		// in its own product, the lease tells whether it is alive
+		ls.SessionState = SESSION_UNKNOWN
+	case errors.IsNotFound(err):
+		ls.SessionState = SESSION_ORPHAN
+		ls.Stale, ls.Reason = true, "holder has no session"
+	case err != nil:
+		return nil, err
+	default:
+		var reason string
+		ls.SessionState, reason = s.state(now)
+		ls.Command = s.Command
+		ls.StartAt = s.StartAt
+		if ls.SessionState == SESSION_ORPHAN {
+			ls.Stale, ls.Reason = true, "holder session is orphan, "+reason
+		}
+	}
+	if age := now.Unix() - l.Renewed; l.Lease > 0 && age > l.Lease {
+		ls.Stale, ls.Reason = true, fmt.Sprintf("lease of %ds expired %ds ago", l.Lease, age-l.Lease)
+	}
+	return ls, nil
+}
+
+// heldLock is a product lock taken by this cli, renewed until released.
+// Every write compares the record with the last one written, so a lock
+// taken over by another cli is never overwritten.
+type heldLock struct {
+	st   *models.Store
+	lc   LockClient
+	lock *ProductLock
+	// the record as last written
+	data   []byte
+	onLost func()
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func (h *heldLock) encode() ([]byte, error) {
+	b, err := json.Marshal(h.lock)
+	return b, errors.Trace(err)
+}
+
+func (h *heldLock) renew() {
+	defer h.wg.Done()
+	ticker := time.NewTicker(time.Duration(h.lock.Lease) * time.Second / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+		}
+		h.lock.Renewed = time.Now().Unix()
+		b, err := h.encode()
+		if err != nil {
+			log.Warnf("renew product lock failed: %v", err)
+			continue
+		}
+		ok, err := h.lc.Swap(h.st.LockPath(), h.data, b)
+		if err != nil {
+			log.Warnf("renew product lock failed: %v", err)
+			continue
+		} else if !ok {
+			log.Errorf("product lock was taken over by another cli, stop")
+			if h.onLost != nil {
+				h.onLost()
+			}
+			return
+		}
+		h.data = b
+	}
+}
+
+// release stops renewing and deletes the lock if this cli still holds it.
+func (h *heldLock) release() {
+	close(h.done)
+	h.wg.Wait()
+	if ok, err := h.lc.Delete(h.st.LockPath(), h.data); err != nil {
+		log.Warnf("release product lock failed: %v", err)
+	} else if !ok {
+		log.Warnf("product lock is no longer held by this cli, not released")
+	}
+}
+
+// ErrProductLockLost stops a migration whose product lock was taken over.
+var ErrProductLockLost = errors.New("product lock was taken over by another cli")
+
+// lockProduct takes the product lock, replacing store.Lock() which does not
+// exclude other clis on every coordinator. A lock held by another live cli
+// is waited for up to lockWait, a stale one is taken over. A lock held
+// under the same name, by this process or a cli of the same host and pid,
+// is waited for too. onLost, if not
+// nil, is called when another cli takes the lock over meanwhile. The
+// returned func releases the lock.
+func lockProduct(onLost func()) (func(), error) {
+	return lockProductIn(store, lockClient, onLost)
+}
+
+// lockProductIn takes the lock of the product of st, lockProduct.
+func lockProductIn(st *models.Store, lc LockClient, onLost func()) (func(), error) {
+	if lc == nil {
+		return nil, errors.New("no lock client for the coordinator")
+	}
+	h := &heldLock{st: st, lc: lc, lock: newProductLock(), onLost: onLost, done: make(chan struct{})}
+	b, err := h.encode()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	var reported time.Time
+	for {
+		ls, err := loadLockStatusIn(st)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		switch {
+		case !ls.Held:
+			ok, err = lc.Create(st.LockPath(), b)
+		case ls.Stale:
+			log.Warnf("take over product lock of %s: %s", ls, ls.Reason)
+			ok, err = lc.Swap(st.LockPath(), ls.data, b)
+		case lockNoWait:
+			return nil, errors.Errorf("product lock is held by %s, see `lock status`", ls)
+		default:
+			waited := time.Since(start)
+			if waited >= lockWait {
+				return nil, errors.Errorf("product lock is still held by %s after waiting %v", ls, lockWait)
+			}
+			if time.Since(reported) >= lockMessageInterval {
+				log.Infof("waiting for product lock held by %s, waited %v of %v",
+					ls, waited.Truncate(time.Second), lockWait)
+				reported = time.Now()
+			}
+			time.Sleep(lockPollInterval)
+			continue
+		}
+		if err != nil {
+			return nil, errors.Annotate(err, "take product lock")
+		} else if ok {
+			break
+		}
+		// another cli changed the lock meanwhile
+		if time.Since(start) >= lockWait || lockNoWait {
+			return nil, errors.New("product lock was taken by another cli, see `lock status`")
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	h.data = b
+	log.Debugf("product lock of %s taken by %s", st.LockPath(), h.lock.Name())
+	h.wg.Add(1)
+	go h.renew()
+	return h.release, nil
+}
+
+func NewLockCmd() *cli.Command {
+	return &cli.Command{
+		Name: "lock",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "status",
+				Description: "show which cli holds the product lock used by migrations",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "output format (text, json)",
+						Value: "text",
+					},
+				},
+				Action: runLockStatus,
+			},
+		},
+		Before: loadContext,
+	}
+}
+
+func runLockStatus(context *cli.Context) error {
+	st, err := loadLockStatus()
+	if err != nil {
+		return err
+	}
+	switch format := context.String("format"); format {
+	case "json":
+		b, _ := json.MarshalIndent(st, " ", "  ")
+		fmt.Println(string(b))
+		return nil
+	case "text":
+	default:
+		return errors.Errorf("invalid format %q, should be one of (text, json)", format)
+	}
+
+	if !st.Held {
+		fmt.Println("lock is free")
+		return nil
+	}
+	fmt.Printf("lock held by %s (host %s, pid %d)\n", st.Holder, st.Hostname, st.Pid)
+	if st.AcquiredAt != 0 {
+		fmt.Printf("acquired: %s, renewed: %s, lease: %ds\n", formatUnix(st.AcquiredAt), formatUnix(st.Renewed), st.Lease)
+	}
+	fmt.Printf("session: %s\n", st.SessionState)
+	if st.StartAt != 0 {
+		fmt.Printf("started: %s\n", formatUnix(st.StartAt))
+	}
+	if st.Command != "" {
+		fmt.Printf("command: %s\n", st.Command)
+	}
+	if st.Stale {
+		fmt.Printf("stale: %s, the next migration takes it over\n", st.Reason)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"context"
+	"time"
+
+	codiserrors "github.com/CodisLabs/codis/pkg/utils/errors"
+	zkclient "github.com/IceFireDB/kit/pkg/models/client/zk"
+	"github.com/juju/errors"
+	"github.com/samuel/go-zookeeper/zk"
+	etcdv2 "go.etcd.io/etcd/client/v2"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// LockClient changes the product lock atomically, the kit clients only
+// put, so two clis could both take a free lock.
+type LockClient interface {
+	// Create writes path unless it exists.
+	Create(path string, data []byte) (bool, error)
+	// Swap replaces the data of path only while it still holds old.
+	Swap(path string, old, data []byte) (bool, error)
+	// Delete removes path only while it still holds old.
+	Delete(path string, old []byte) (bool, error)
+	Close() error
+}
+
+// lockClient is set up by loadContext, nil when the coordinator has none.
+var lockClient LockClient
+
+// etcdLockClient takes the lock with etcd v3 transactions on the
+// connection of the coordinator client, it is closed with that client.
+type etcdLockClient struct {
+	client  *clientv3.Client
+	timeout time.Duration
+}
+
+func NewEtcdLockClient(c *clientv3.Client, timeout time.Duration) LockClient {
+	return &etcdLockClient{client: c, timeout: timeout}
+}
+
+func (c *etcdLockClient) txn(cmp clientv3.Cmp, op clientv3.Op) (bool, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	r, err := c.client.Txn(cntx).If(cmp).Then(op).Commit()
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	return r.Succeeded, nil
+}
+
+func (c *etcdLockClient) Create(path string, data []byte) (bool, error) {
+	return c.txn(clientv3.Compare(clientv3.CreateRevision(path), "=", 0), clientv3.OpPut(path, string(data)))
+}
+
+func (c *etcdLockClient) Swap(path string, old, data []byte) (bool, error) {
+	return c.txn(clientv3.Compare(clientv3.Value(path), "=", string(old)), clientv3.OpPut(path, string(data)))
+}
+
+func (c *etcdLockClient) Delete(path string, old []byte) (bool, error) {
+	return c.txn(clientv3.Compare(clientv3.Value(path), "=", string(old)), clientv3.OpDelete(path))
+}
+
+func (c *etcdLockClient) Close() error {
+	return nil
+}
+
+// etcdV2LockClient takes the lock with etcd v2 conditional writes.
+type etcdV2LockClient struct {
+	kapi    etcdv2.KeysAPI
+	timeout time.Duration
+}
+
+func NewEtcdV2LockClient(addr, user, password string, timeout time.Duration) (LockClient, error) {
+	c, err := etcdv2.New(etcdv2.Config{
+		Endpoints:               etcdEndpoints(addr, false),
+		Transport:               etcdv2.DefaultTransport,
+		HeaderTimeoutPerRequest: timeout,
+		Username:                user,
+		Password:                password,
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "connect etcd %s", addr)
+	}
+	return &etcdV2LockClient{kapi: etcdv2.NewKeysAPI(c), timeout: timeout}, nil
+}
+
+// conditionFailed tells a lost race from a failure.
+func conditionFailed(err error) bool {
+	if e, ok := err.(etcdv2.Error); ok {
+		switch e.Code {
+		case etcdv2.ErrorCodeNodeExist, etcdv2.ErrorCodeTestFailed, etcdv2.ErrorCodeKeyNotFound:
+			return true
+		}
+	}
+	return false
+}
+
+func (c *etcdV2LockClient) do(fn func(cntx context.Context) error) (bool, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	err := fn(cntx)
+	switch {
+	case err == nil:
+		return true, nil
+	case conditionFailed(err):
+		return false, nil
+	}
+	return false, errors.Trace(err)
+}
+
+func (c *etcdV2LockClient) Create(path string, data []byte) (bool, error) {
+	return c.do(func(cntx context.Context) error {
+		_, err := c.kapi.Set(cntx, path, string(data), &etcdv2.SetOptions{PrevExist: etcdv2.PrevNoExist})
+		return err
+	})
+}
+
+func (c *etcdV2LockClient) Swap(path string, old, data []byte) (bool, error) {
+	return c.do(func(cntx context.Context) error {
+		_, err := c.kapi.Set(cntx, path, string(data), &etcdv2.SetOptions{PrevValue: string(old), PrevExist: etcdv2.PrevExist})
+		return err
+	})
+}
+
+func (c *etcdV2LockClient) Delete(path string, old []byte) (bool, error) {
+	return c.do(func(cntx context.Context) error {
+		_, err := c.kapi.Delete(cntx, path, &etcdv2.DeleteOptions{PrevValue: string(old)})
+		return err
+	})
+}
+
+func (c *etcdV2LockClient) Close() error {
+	return nil
+}
+
+// zkLockClient uses the versions of zookeeper nodes on the connection of
+// the kit client, it is closed with that client.
+type zkLockClient struct {
+	client *zkclient.Client
+}
+
+func NewZkLockClient(c *zkclient.Client) LockClient {
+	return &zkLockClient{client: c}
+}
+
+func (c *zkLockClient) Create(path string, data []byte) (bool, error) {
+	// zookeeper refuses to create an existing node
+	err := c.client.Create(path, data)
+	switch {
+	case err == nil:
+		return true, nil
+	case codiserrors.Equal(err, zk.ErrNodeExists):
+		return false, nil
+	}
+	return false, errors.Trace(err)
+}
+
+// ifHolds runs fn with the version of path when path holds old.
+func (c *zkLockClient) ifHolds(path string, old []byte, fn func(conn *zk.Conn, version int32) error) (bool, error) {
+	ok := false
+	err := c.client.Do(func(conn *zk.Conn) error {
+		b, stat, err := conn.Get(path)
+		if err == zk.ErrNoNode {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if string(b) != string(old) {
+			return nil
+		}
+		err = fn(conn, stat.Version)
+		if err == zk.ErrBadVersion || err == zk.ErrNoNode {
+			return nil
+		}
+		ok = err == nil
+		return err
+	})
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	return ok, nil
+}
+
+func (c *zkLockClient) Swap(path string, old, data []byte) (bool, error) {
+	return c.ifHolds(path, old, func(conn *zk.Conn, version int32) error {
+		_, err := conn.Set(path, data, version)
+		return err
+	})
+}
+
+func (c *zkLockClient) Delete(path string, old []byte) (bool, error) {
+	return c.ifHolds(path, old, func(conn *zk.Conn, version int32) error {
+		return conn.Delete(path, version)
+	})
+}
+
+func (c *zkLockClient) Close() error {
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/IceFireDB/kit/pkg/models"
+)
+
+// holdLockByOther writes the lock of a live cli on another host.
+func holdLockByOther(t *testing.T, c *memClient) *ProductLock {
+	t.Helper()
+	host, _ := os.Hostname()
+	now := time.Now().Unix()
+	l := &ProductLock{Hostname: host + "-other", Pid: 4242, AcquiredAt: now, Renewed: now, Lease: 30}
+	s := &Session{Name: l.Name(), Hostname: l.Hostname, Pid: l.Pid, StartAt: now, Heartbeat: now, TTL: 30}
+	if err := saveSession(store, s); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(l)
+	if err := c.Update(store.LockPath(), b); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLockProduct(t *testing.T) {
+	useMemStore(t, 4)
+	unlock, err := lockProduct(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := loadLockStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Held || st.Pid != os.Getpid() {
+		t.Fatalf("lock status %+v after lockProduct", st)
+	}
+	unlock()
+	if st, _ := loadLockStatus(); st.Held {
+		t.Errorf("lock still held after release: %+v", st)
+	}
+}
+
+func TestLockProductHeldByOther(t *testing.T) {
+	c := useMemStore(t, 4)
+	holdLockByOther(t, c)
+	defer func(v bool) { lockNoWait = v }(lockNoWait)
+	lockNoWait = true
+	if _, err := lockProduct(nil); err == nil {
+		t.Fatal("lock held by a live cli was taken")
+	}
+}
+
+func TestLockProductNested(t *testing.T) {
+	useMemStore(t, 4)
+	lost := false
+	unlock, err := lockProduct(func() { lost = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	defer func(v bool) { lockNoWait = v }(lockNoWait)
+	lockNoWait = true
+	if _, err := lockProduct(nil); err == nil {
+		t.Fatal("lock held under the same name was taken over")
+	}
+	if ls, err := loadLockStatus(); err != nil || ls.Pid != os.Getpid() || lost {
+		t.Errorf("lock status %+v, %v, lost %v", ls, err, lost)
+	}
+}
+
+func TestLockProductTakenOver(t *testing.T) {
+	c := useMemStore(t, 4)
+	unlock, err := lockProduct(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := holdLockByOther(t, c)
+	unlock()
+	st, err := loadLockStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Held || st.Holder != other.Name() {
+		t.Errorf("release removed the lock of another cli: %+v", st)
+	}
+}
+
+func TestLockOtherProduct(t *testing.T) {
+	c := useMemStore(t, 4)
+	target := models.NewStore(c, "target")
+	unlock, err := lockProductIn(target, lockClient, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	// this cli has no session in the target product
+	st, err := loadLockStatusIn(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Held || st.Stale {
+		t.Errorf("lock of the target product %+v, want held and not stale", st)
+	}
+}
+
+func TestMigrateTaskStop(t *testing.T) {
+	task := &MigrateTask{}
+	task.stop(ErrProductLockLost)
+	task.stop(ErrStopMigrateByUser)
+	select {
+	case <-task.stopChan:
+	default:
+		t.Fatal("stopChan not closed")
+	}
+	if err := task.stopReason(); err != ErrProductLockLost {
+		t.Errorf("stop reason %v, want %v", err, ErrProductLockLost)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/IceFireDB/kit/pkg/models/client"
+	"github.com/juju/errors"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+	kitlog "github.com/IceFireDB/kit/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	log.Init("cli", log.WithOutputLevelString("error"))
+	kitlog.Init("kit", kitlog.WithOutputLevelString("error"))
+	os.Exit(m.Run())
+}
+
+// memClient is a coordinator kept in memory, with the semantics of the kit
+// etcd client.
+type memClient struct {
+	sync.Mutex
+	nodes   map[string][]byte
+	ordered int
+}
+
+func newMemClient() *memClient {
+	return &memClient{nodes: make(map[string][]byte)}
+}
+
+func (c *memClient) Create(path string, data []byte) error {
+	return c.Update(path, data)
+}
+
+func (c *memClient) CreateInOrder(path string, data []byte) (string, error) {
+	c.Lock()
+	c.ordered++
+	p := fmt.Sprintf("%s/%06d", strings.TrimSuffix(path, "/"), c.ordered)
+	c.Unlock()
+	return p, c.Update(p, data)
+}
+
+func (c *memClient) Update(path string, data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	c.nodes[path] = append([]byte(nil), data...)
+	return nil
+}
+
+func (c *memClient) Delete(path string) error {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.nodes, path)
+	return nil
+}
+
+func (c *memClient) Read(path string, must bool) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	b, ok := c.nodes[path]
+	if !ok && must {
+		return nil, errors.NotFoundf("node %s", path)
+	}
+	return b, nil
+}
+
+func (c *memClient) List(path string, must bool) ([]string, error) {
+	c.Lock()
+	defer c.Unlock()
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	var paths []string
+	for p := range c.nodes {
+		if strings.HasPrefix(p, prefix) {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 && must {
+		return nil, errors.NotFoundf("dir %s", path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (c *memClient) Close() error {
+	return nil
+}
+
+func (c *memClient) WatchInOrder(path string) (<-chan client.Event, []string, error) {
+	paths, err := c.List(path, false)
+	return make(chan client.Event), paths, err
+}
+
+// useMemStore points the package at a fresh in-memory coordinator.
+func useMemStore(t *testing.T, slots int) *memClient {
+	t.Helper()
+	c := newMemClient()
+	store = models.NewStore(c, "test")
+	lockClient = memLockClient{c}
+	slotSizeCache = nil
+	productName = "test"
+	slotNum = slots
+	return c
+}
+
+func addTestServer(t *testing.T, groupId int, addr string, tp models.ServerType) {
+	t.Helper()
+	srv := &models.Server{GroupId: groupId, Addr: addr, Type: tp}
+	if err := store.UpdateServer(srv); err != nil {
+		t.Fatal(err)
+	}
+	g, err := store.LoadGroup(groupId, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g == nil {
+		g = models.NewServerGroup(productName, groupId)
+	}
+	g.Servers = append(g.Servers, *srv)
+	if err := store.UpdateGroup(g); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// memLockClient changes the nodes of a memClient atomically.
+type memLockClient struct {
+	c *memClient
+}
+
+func (l memLockClient) Create(path string, data []byte) (bool, error) {
+	l.c.Lock()
+	defer l.c.Unlock()
+	if _, ok := l.c.nodes[path]; ok {
+		return false, nil
+	}
+	l.c.nodes[path] = append([]byte(nil), data...)
+	return true, nil
+}
+
+func (l memLockClient) Swap(path string, old, data []byte) (bool, error) {
+	l.c.Lock()
+	defer l.c.Unlock()
+	if b, ok := l.c.nodes[path]; !ok || string(b) != string(old) {
+		return false, nil
+	}
+	l.c.nodes[path] = append([]byte(nil), data...)
+	return true, nil
+}
+
+func (l memLockClient) Delete(path string, old []byte) (bool, error) {
+	l.c.Lock()
+	defer l.c.Unlock()
+	if b, ok := l.c.nodes[path]; !ok || string(b) != string(old) {
+		return false, nil
+	}
+	delete(l.c.nodes, path)
+	return true, nil
+}
+
+func (l memLockClient) Close() error {
+	return nil
+}
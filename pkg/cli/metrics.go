@@ -0,0 +1,138 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/IceFireDB/kit/pkg/models/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are exposed in the Prometheus text format on /metrics when the cli
+// is started with --metrics-addr.
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	migrateSlotsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "icefiredb_cli_migrate_slots_total",
+		Help: "Slots migrated to their new group.",
+	})
+	migrateKeysTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "icefiredb_cli_migrate_keys_total",
+		Help: "Keys moved by migratedb.",
+	}, []string{"type"})
+	migrateErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "icefiredb_cli_migrate_errors_total",
+		Help: "Migration errors by stage.",
+	}, []string{"stage"})
+	migrateRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "icefiredb_cli_migrate_retries_total",
+		Help: "Retried migratedb calls by error class.",
+	}, []string{"class"})
+	migratedbDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "icefiredb_cli_migratedb_duration_seconds",
+		Help: "Latency of a migratedb call.",
+	}, []string{"type"})
+	migrateTaskPercent = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "icefiredb_cli_migrate_task_percent",
+		Help: "Progress of the running migrate task.",
+	})
+	coordinatorDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "icefiredb_cli_coordinator_duration_seconds",
+		Help: "Latency of coordinator operations.",
+	}, []string{"op"})
+	coordinatorErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "icefiredb_cli_coordinator_errors_total",
+		Help: "Failed coordinator operations.",
+	}, []string{"op"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		migrateSlotsTotal,
+		migrateKeysTotal,
+		migrateErrorsTotal,
+		migrateRetriesTotal,
+		migratedbDuration,
+		migrateTaskPercent,
+		coordinatorDuration,
+		coordinatorErrorsTotal,
+	)
+}
+
+// MetricsHandler serves the registered metrics.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// instrumentedClient records the latency and errors of coordinator operations.
+type instrumentedClient struct {
+	client.Client
+}
+
+// InstrumentClient wraps a coordinator client so its operations show up in
+// the metrics.
+func InstrumentClient(c client.Client) client.Client {
+	return &instrumentedClient{c}
+}
+
+func (c *instrumentedClient) observe(op string, start time.Time, err error) {
+	coordinatorDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		coordinatorErrorsTotal.WithLabelValues(op).Inc()
+	}
+}
+
+func (c *instrumentedClient) Create(path string, data []byte) error {
+	start := time.Now()
+	err := c.Client.Create(path, data)
+	c.observe("create", start, err)
+	return err
+}
+
+func (c *instrumentedClient) CreateInOrder(path string, data []byte) (string, error) {
+	start := time.Now()
+	p, err := c.Client.CreateInOrder(path, data)
+	c.observe("create_in_order", start, err)
+	return p, err
+}
+
+func (c *instrumentedClient) Update(path string, data []byte) error {
+	start := time.Now()
+	err := c.Client.Update(path, data)
+	c.observe("update", start, err)
+	return err
+}
+
+func (c *instrumentedClient) Delete(path string) error {
+	start := time.Now()
+	err := c.Client.Delete(path)
+	c.observe("delete", start, err)
+	return err
+}
+
+func (c *instrumentedClient) Read(path string, must bool) ([]byte, error) {
+	start := time.Now()
+	b, err := c.Client.Read(path, must)
+	c.observe("read", start, err)
+	return b, err
+}
+
+func (c *instrumentedClient) List(path string, must bool) ([]string, error) {
+	start := time.Now()
+	paths, err := c.Client.List(path, must)
+	c.observe("list", start, err)
+	return paths, err
+}
+
+func (c *instrumentedClient) WatchInOrder(path string) (<-chan client.Event, []string, error) {
+	start := time.Now()
+	ch, paths, err := c.Client.WatchInOrder(path)
+	c.observe("watch", start, err)
+	return ch, paths, err
+}
@@ -0,0 +1,670 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/IceFireDB/kit/pkg/router"
+	"github.com/garyburd/redigo/redis"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+const (
+	MIGRATE_CHECK_TARGET      string = "target"
+	MIGRATE_CHECK_CAPACITY    string = "capacity"
+	MIGRATE_CHECK_VERSION     string = "version"
+	MIGRATE_CHECK_REPLICATION string = "replication"
+	MIGRATE_CHECK_PROXY       string = "proxy"
+
+	// free space of the target master as a multiple of the estimated size
+	defaultMinHeadroom = 1.5
+	// replication offset a follower may be behind its master, in bytes
+	defaultMaxReplicationLag = 1 << 20
+	// slot sizes measured this recently are not measured again
+	defaultStatsMaxAge = time.Hour
+	// the probe key written to the target master expires on its own if
+	// the cli dies before deleting it
+	migrateProbeTTL = 60
+)
+
+// migrateCheck is a safety check run before a migration starts.
+type migrateCheck struct {
+	name string
+	flag string
+	run  func(p *migratePreflight) error
+}
+
+var migrateChecks = []migrateCheck{
+	{MIGRATE_CHECK_TARGET, "skip-target-check", checkMigrateTarget},
+	{MIGRATE_CHECK_CAPACITY, "skip-capacity-check", checkMigrateCapacity},
+	{MIGRATE_CHECK_VERSION, "skip-version-check", checkMigrateVersion},
+	{MIGRATE_CHECK_REPLICATION, "skip-replication-check", checkMigrateReplication},
+	{MIGRATE_CHECK_PROXY, "skip-proxy-check", checkMigrateProxies},
+}
+
+var (
+	// checks skipped by the running command
+	skippedChecks = map[string]bool{}
+	minHeadroom   = defaultMinHeadroom
+	statsMaxAge   = defaultStatsMaxAge
+	maxReplLag    = int64(defaultMaxReplicationLag)
+)
+
+var migrateCheckFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "skip-target-check",
+		Usage: "do not check that the master of the target group is reachable and writable",
+	},
+	&cli.BoolFlag{
+		Name:  "skip-capacity-check",
+		Usage: "do not compare the free memory and disk of the target master with the estimated slot size, estimating scans every key of the source groups unless slot stats or an earlier check measured the slots within --stats-max-age",
+	},
+	&cli.DurationFlag{
+		Name:  "stats-max-age",
+		Usage: "reuse slot sizes measured this recently for the capacity check",
+		Value: defaultStatsMaxAge,
+	},
+	&cli.Float64Flag{
+		Name:  "min-headroom",
+		Usage: "free space required on the target master as a multiple of the estimated slot size",
+		Value: defaultMinHeadroom,
+	},
+	&cli.BoolFlag{
+		Name:  "skip-version-check",
+		Usage: "do not check that source and target run compatible versions supporting migratedb",
+	},
+	&cli.BoolFlag{
+		Name:  "skip-replication-check",
+		Usage: "do not check the replication links of the source and target groups",
+	},
+	&cli.Int64Flag{
+		Name:  "max-replication-lag",
+		Usage: "bytes of replication offset a follower may be behind its master",
+		Value: defaultMaxReplicationLag,
+	},
+	&cli.BoolFlag{
+		Name:  "skip-proxy-check",
+		Usage: "do not check that every proxy is online",
+	},
+}
+
+func setMigrateChecks(c *cli.Context) error {
+	if h := c.Float64("min-headroom"); h < 1 {
+		return errors.Errorf("invalid min headroom %v, should be at least 1", h)
+	}
+	minHeadroom = c.Float64("min-headroom")
+	if d := c.Duration("stats-max-age"); d < 0 {
+		return errors.Errorf("invalid stats max age %v", d)
+	}
+	statsMaxAge = c.Duration("stats-max-age")
+	if l := c.Int64("max-replication-lag"); l < 0 {
+		return errors.Errorf("invalid max replication lag %d", l)
+	}
+	maxReplLag = c.Int64("max-replication-lag")
+	skippedChecks = make(map[string]bool, len(migrateChecks))
+	for _, check := range migrateChecks {
+		skippedChecks[check.name] = c.Bool(check.flag)
+	}
+	return nil
+}
+
+// migratePreflight is what the checks look at: the slots of a task still
+// to move, the masters of their groups and the master of the target group.
+type migratePreflight struct {
+	task   *MigrateTask
+	target *Cluster
+	// slot id -> source group
+	slots map[int]int
+	// source group -> master
+	sources map[int]*models.Server
+	master  *models.Server
+	// why the target group has no master
+	masterErr error
+}
+
+func newMigratePreflight(t *MigrateTask, target *Cluster) (*migratePreflight, error) {
+	p := &migratePreflight{
+		task:    t,
+		target:  target,
+		slots:   make(map[int]int),
+		sources: make(map[int]*models.Server),
+	}
+	slots, err := loadSlots(t.FromSlot, t.ToSlot)
+	if err != nil {
+		return nil, err
+	}
+	local := target.Store == store
+	for _, s := range slots {
+		from := s.GroupId
+		if s.State.Status == models.SLOT_STATUS_MIGRATE || s.State.Status == models.SLOT_STATUS_PRE_MIGRATE {
+			from = s.State.MigrateStatus.From
+		}
+		if from == models.INVALID_ID || (local && from == t.NewGroupId) {
+			continue
+		}
+		p.slots[s.Id] = from
+		if _, ok := p.sources[from]; ok {
+			continue
+		}
+		m, err := loadGroupMaster(from)
+		if err != nil {
+			return nil, errors.Annotatef(err, "source of slot %d", s.Id)
+		}
+		p.sources[from] = m
+	}
+
+	g, err := target.Store.LoadGroup(t.NewGroupId, true)
+	if err != nil {
+		return nil, errors.Annotatef(err, "load group %d of product %s", t.NewGroupId, target.Product)
+	}
+	if p.master, err = target.Store.Master(g); err != nil {
+		p.masterErr = errors.Annotatef(err, "group %d of product %s, %s", t.NewGroupId, target.Product, describeGroupServers(target.Store, g))
+	}
+	return p, nil
+}
+
+func (p *migratePreflight) sourceGroups() []int {
+	groups := make([]int, 0, len(p.sources))
+	for g := range p.sources {
+		groups = append(groups, g)
+	}
+	sort.Ints(groups)
+	return groups
+}
+
+func (p *migratePreflight) dialTarget() (redis.Conn, error) {
+	if p.master == nil {
+		return nil, p.masterErr
+	}
+	return dialServerWith(p.target.DataNode, p.master.Addr)
+}
+
+// checkMigrateSafety runs the checks not skipped by flags and fails with
+// every problem found, naming the flag that skips the check.
+func checkMigrateSafety(t *MigrateTask, target *Cluster) error {
+	p, err := newMigratePreflight(t, target)
+	if err != nil {
+		return err
+	}
+	if len(p.slots) == 0 {
+		return nil
+	}
+	var problems []string
+	for _, check := range migrateChecks {
+		if skippedChecks[check.name] {
+			log.Warnf("%s check skipped by --%s", check.name, check.flag)
+			continue
+		}
+		if err := check.run(p); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v (skip with --%s)", check.name, err, check.flag))
+			continue
+		}
+		log.Infof("%s check passed", check.name)
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("migrate task %s failed %d pre-migration checks:\n  %s",
+			t.Id, len(problems), strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// checkMigrateTarget writes and deletes a probe key on the target master.
+func checkMigrateTarget(p *migratePreflight) error {
+	c, err := p.dialTarget()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := c.Do("PING"); err != nil {
+		return errors.Annotatef(err, "ping %s", p.master.Addr)
+	}
+	key := "__migrate_check_" + p.task.Id
+	if _, err := c.Do("setex", key, migrateProbeTTL, p.task.Id); err != nil {
+		return errors.Annotatef(err, "%s is not writable", p.master.Addr)
+	}
+	if _, err := c.Do("del", key); err != nil {
+		return errors.Annotatef(err, "delete probe key %s on %s", key, p.master.Addr)
+	}
+	return nil
+}
+
+// nodeInfo returns the fields of the INFO reply of a data node, of all
+// sections or the given one.
+func nodeInfo(c redis.Conn, section ...interface{}) (map[string]string, error) {
+	s, err := redis.String(c.Do("INFO", section...))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return parseInfo(s), nil
+}
+
+func parseInfo(s string) map[string]string {
+	info := make(map[string]string)
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			info[line[:i]] = line[i+1:]
+		}
+	}
+	return info
+}
+
+func infoInt(info map[string]string, field string) (int64, bool) {
+	v, ok := info[field]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	return n, err == nil
+}
+
+// estimateSlotBytes sums up the sizes of the slots of the task. Sizes
+// measured within statsMaxAge, by `slot stats` or an earlier check, are
+// reused, the other source groups are scanned once and all their slots are
+// recorded for the next entries of a plan or windows of a task.
+func estimateSlotBytes(p *migratePreflight) (int64, error) {
+	now := time.Now()
+	sizes, err := loadSlotSizes()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	scan := make(map[int]bool)
+	for id, gid := range p.slots {
+		if n, ok := sizes.fresh(id, now, statsMaxAge); ok {
+			total += n
+		} else {
+			scan[gid] = true
+		}
+	}
+	if len(scan) == 0 {
+		log.Infof("slot sizes measured within %v reused", statsMaxAge)
+		return total, nil
+	}
+
+	slots, err := store.Slots()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	for _, gid := range p.sourceGroups() {
+		if !scan[gid] {
+			continue
+		}
+		addr := p.sources[gid].Addr
+		log.Infof("scanning the keys of group %d on %s to estimate the slot sizes", gid, addr)
+		bytes, err := scanSlotBytes(addr, gid, slots)
+		if err != nil {
+			return 0, err
+		}
+		for id, from := range p.slots {
+			if from != gid {
+				continue
+			}
+			if _, ok := sizes.fresh(id, now, statsMaxAge); !ok {
+				total += bytes[id]
+			}
+		}
+		if err := saveSlotSizes(bytes, now); err != nil {
+			log.Warnf("save slot sizes failed: %v", err)
+		}
+	}
+	return total, nil
+}
+
+// scanSlotBytes sums up the keys of the slots whose data is on group gid
+// the way `slot stats` does, slots without keys are 0.
+func scanSlotBytes(addr string, gid int, slots []models.Slot) (map[int]int64, error) {
+	bytes := make(map[int]int64)
+	for i := range slots {
+		if slotSource(&slots[i]) == gid {
+			bytes[slots[i].Id] = 0
+		}
+	}
+	c, err := dialServer(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	for _, tp := range dataTypes {
+		err = scanKeyBatches(c, tp, func(keys [][]byte) error {
+			sizes, err := keySizes(c, tp, keys)
+			if err != nil {
+				return err
+			}
+			for i, key := range keys {
+				id := router.MapKey2Slot(key, slotNum)
+				if _, ok := bytes[id]; !ok {
+					continue
+				}
+				n := sizes[i]
+				if tp != "KV" {
+					n *= defaultElemSize
+				}
+				bytes[id] += int64(len(key)) + n
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Annotatef(err, "scan %s on %s", tp, addr)
+		}
+	}
+	return bytes, nil
+}
+
+// slotSource is the group holding the keys of a slot, the source group of
+// a migrating one.
+func slotSource(s *models.Slot) int {
+	if s.State.Status == models.SLOT_STATUS_MIGRATE || s.State.Status == models.SLOT_STATUS_PRE_MIGRATE {
+		return s.State.MigrateStatus.From
+	}
+	return s.GroupId
+}
+
+// INFO fields a data node may report its free space in, either a limit
+// and its usage or the free space itself.
+var capacityFields = []struct {
+	name  string
+	limit string
+	used  string
+	free  string
+}{
+	{name: "memory", limit: "maxmemory", used: "used_memory"},
+	{name: "disk", free: "disk_free"},
+}
+
+// checkMigrateCapacity compares the free memory and disk reported by the
+// target master with the estimated size of the slots. A data node
+// reporting neither is only warned about.
+func checkMigrateCapacity(p *migratePreflight) error {
+	c, err := p.dialTarget()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	info, err := nodeInfo(c)
+	if err != nil {
+		return errors.Annotatef(err, "info %s", p.master.Addr)
+	}
+	estimate, err := estimateSlotBytes(p)
+	if err != nil {
+		return errors.Annotate(err, "estimate slot size")
+	}
+	need := int64(float64(estimate) * minHeadroom)
+
+	known := false
+	for _, f := range capacityFields {
+		var free int64
+		if n, ok := infoInt(info, f.free); ok {
+			free = n
+		} else if limit, ok := infoInt(info, f.limit); ok && limit > 0 {
+			used, _ := infoInt(info, f.used)
+			free = limit - used
+		} else {
+			continue
+		}
+		known = true
+		if free < need {
+			return errors.Errorf("%s has %d bytes of free %s, the slots need about %d bytes (%d estimated x %.1f headroom)",
+				p.master.Addr, free, f.name, need, estimate, minHeadroom)
+		}
+	}
+	if !known {
+		log.Warnf("%s reports no memory or disk limit, cannot compare with the estimated %d bytes of the slots", p.master.Addr, estimate)
+	}
+	return nil
+}
+
+// INFO fields holding the version, the first one present is used
+var versionFields = []string{"icefiredb_version", "ledisdb_version", "version", "redis_version"}
+
+func nodeVersion(info map[string]string) string {
+	for _, f := range versionFields {
+		if v := info[f]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// majorMinor cuts a version like 1.2.3 down to 1.2, versions are
+// compatible when it matches.
+func majorMinor(v string) string {
+	parts := strings.SplitN(strings.TrimPrefix(v, "v"), ".", 3)
+	if len(parts) < 2 {
+		return parts[0]
+	}
+	return parts[0] + "." + parts[1]
+}
+
+func isUnknownCommand(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unknown command") || strings.Contains(msg, "command not found")
+}
+
+// probeNode returns the version of a data node and fails when it does not
+// know migratedb. The command is sent without arguments, a data node
+// supporting it only complains about them.
+func probeNode(c redis.Conn, addr string) (string, error) {
+	info, err := nodeInfo(c)
+	if err != nil {
+		return "", errors.Annotatef(err, "info %s", addr)
+	}
+	if _, err := c.Do("migratedb"); err != nil {
+		if _, ok := err.(redis.Error); !ok {
+			return "", errors.Annotatef(err, "probe migratedb on %s", addr)
+		}
+		if isUnknownCommand(err) {
+			return "", errors.Errorf("%s does not support migratedb: %v", addr, err)
+		}
+	}
+	return nodeVersion(info), nil
+}
+
+// checkMigrateVersion requires migratedb on every master involved and the
+// same major.minor version where they report one.
+func checkMigrateVersion(p *migratePreflight) error {
+	versions := make(map[string]string)
+	for _, gid := range p.sourceGroups() {
+		addr := p.sources[gid].Addr
+		c, err := dialServer(addr)
+		if err != nil {
+			return err
+		}
+		v, err := probeNode(c, addr)
+		c.Close()
+		if err != nil {
+			return err
+		}
+		versions[addr] = v
+	}
+	c, err := p.dialTarget()
+	if err != nil {
+		return err
+	}
+	v, err := probeNode(c, p.master.Addr)
+	c.Close()
+	if err != nil {
+		return err
+	}
+	versions[p.master.Addr] = v
+
+	addrs := make([]string, 0, len(versions))
+	for addr := range versions {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	var want string
+	var described []string
+	mismatch := false
+	for _, addr := range addrs {
+		v := versions[addr]
+		if v == "" {
+			log.Warnf("%s reports no version, cannot check compatibility", addr)
+			continue
+		}
+		described = append(described, fmt.Sprintf("%s %s", addr, v))
+		if want == "" {
+			want = majorMinor(v)
+		} else if majorMinor(v) != want {
+			mismatch = true
+		}
+	}
+	if mismatch {
+		return errors.Errorf("incompatible versions: %s", strings.Join(described, ", "))
+	}
+	return nil
+}
+
+// groupReplicationProblems lists what is wrong with the servers of a group
+// of st: no or several masters, and followers that are unreachable, whose
+// link to the master is down or that are more than maxReplLag behind it,
+// as told by INFO replication.
+func groupReplicationProblems(st *models.Store, dn *DataNodeConfig, groupId int) []string {
+	g, err := st.LoadGroup(groupId, true)
+	if err != nil {
+		return []string{fmt.Sprintf("group %d: %v", groupId, err)}
+	}
+	servers, err := st.GetServers(g)
+	if err != nil {
+		return []string{fmt.Sprintf("group %d: %v", groupId, err)}
+	}
+	var problems []string
+	var master *models.Server
+	var followers []models.Server
+	for i, s := range servers {
+		switch s.Type {
+		case models.ServerTypeLeader:
+			if master != nil {
+				problems = append(problems, fmt.Sprintf("group %d has several masters: %s, %s", groupId, master.Addr, s.Addr))
+			}
+			master = &servers[i]
+		case models.ServerTypeFollower:
+			followers = append(followers, s)
+		default:
+			problems = append(problems, fmt.Sprintf("group %d: %s is %s", groupId, s.Addr, s.Type))
+		}
+	}
+	if master == nil {
+		return append(problems, fmt.Sprintf("group %d has no master", groupId))
+	}
+	if len(followers) == 0 {
+		return problems
+	}
+	masterInfo, err := replicationInfo(dn, master.Addr)
+	if err != nil {
+		return append(problems, fmt.Sprintf("group %d: master %s: %v", groupId, master.Addr, err))
+	}
+	for _, f := range followers {
+		info, err := replicationInfo(dn, f.Addr)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("group %d: follower %s is unreachable: %v", groupId, f.Addr, err))
+		} else if p := followerProblem(masterInfo, info, maxReplLag); p != "" {
+			problems = append(problems, fmt.Sprintf("group %d: follower %s %s", groupId, f.Addr, p))
+		}
+	}
+	return problems
+}
+
+func replicationInfo(dn *DataNodeConfig, addr string) (map[string]string, error) {
+	c, err := dialServerWith(dn, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return nodeInfo(c, "replication")
+}
+
+// followerProblem compares the INFO replication fields of a follower with
+// those of its master, "" when the follower is in sync.
+func followerProblem(master, follower map[string]string, maxLag int64) string {
+	if role := follower["role"]; role != "slave" && role != "replica" {
+		return fmt.Sprintf("reports role %q, not a replica", role)
+	}
+	switch link := follower["master_link_status"]; link {
+	case "up":
+	case "":
+		return "reports no link status to the master"
+	default:
+		return fmt.Sprintf("has its link to the master %s", link)
+	}
+	masterOffset, ok1 := infoInt(master, "master_repl_offset")
+	offset, ok2 := infoInt(follower, "slave_repl_offset")
+	if !ok1 || !ok2 {
+		return "reports no replication offset"
+	}
+	if lag := masterOffset - offset; lag > maxLag {
+		return fmt.Sprintf("is %d bytes behind the master, more than %d", lag, maxLag)
+	}
+	return ""
+}
+
+// checkMigrateReplication checks the source groups and the target group.
+func checkMigrateReplication(p *migratePreflight) error {
+	var problems []string
+	for _, gid := range p.sourceGroups() {
+		problems = append(problems, groupReplicationProblems(store, dataNode, gid)...)
+	}
+	problems = append(problems, groupReplicationProblems(p.target.Store, p.target.DataNode, p.task.NewGroupId)...)
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// proxyProblems lists the proxies of st that are not online.
+func proxyProblems(st *models.Store, product string) ([]string, error) {
+	paths, err := st.Client().List(st.ProxyDir(), false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var problems []string
+	for _, p := range paths {
+		pi, err := st.LoadProxy(path.Base(p))
+		if err != nil {
+			return nil, errors.Annotatef(err, "load proxy %s", path.Base(p))
+		}
+		if pi == nil || pi.State == models.PROXY_STATE_ONLINE {
+			continue
+		}
+		desc := fmt.Sprintf("proxy %s (%s) of product %s is %s", pi.Id, pi.Addr, product, pi.State)
+		if pi.Description != "" {
+			desc += ": " + pi.Description
+		}
+		problems = append(problems, desc)
+	}
+	return problems, nil
+}
+
+// checkMigrateProxies requires every proxy of both products to be online,
+// a proxy missing the slot actions would keep routing to the old group.
+func checkMigrateProxies(p *migratePreflight) error {
+	problems, err := proxyProblems(store, productName)
+	if err != nil {
+		return err
+	}
+	if p.target.Store != store {
+		more, err := proxyProblems(p.target.Store, p.target.Product)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, more...)
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
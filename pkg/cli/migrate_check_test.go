@@ -0,0 +1,69 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IceFireDB/kit/pkg/models"
+)
+
+func TestEstimateSlotBytesCached(t *testing.T) {
+	// nothing listens on the source master, a scan fails
+	p := &migratePreflight{
+		slots:   map[int]int{0: 1, 1: 1},
+		sources: map[int]*models.Server{1: {GroupId: 1, Addr: "127.0.0.1:1"}},
+	}
+	tests := []struct {
+		name    string
+		age     time.Duration
+		slots   map[int]int64
+		want    int64
+		wantErr bool
+	}{
+		{"fresh", time.Minute, map[int]int64{0: 100, 1: 50}, 150, false},
+		{"stale", 2 * defaultStatsMaxAge, map[int]int64{0: 100, 1: 50}, 0, true},
+		{"partly measured", time.Minute, map[int]int64{0: 100}, 0, true},
+	}
+	for _, tt := range tests {
+		useMemStore(t, 4)
+		setTestSlot(t, 0, 1, models.INVALID_ID)
+		setTestSlot(t, 1, 1, models.INVALID_ID)
+		if err := saveSlotSizes(tt.slots, time.Now().Add(-tt.age)); err != nil {
+			t.Fatal(err)
+		}
+		// read back from the coordinator as a new cli would
+		slotSizeCache = nil
+		got, err := estimateSlotBytes(p)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+		} else if got != tt.want {
+			t.Errorf("%s: estimated %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFollowerProblem(t *testing.T) {
+	master := parseInfo("# Replication\r\nrole:master\r\nconnected_slaves:1\r\nmaster_repl_offset:5000\r\n")
+	tests := []struct {
+		name     string
+		follower string
+		want     string
+	}{
+		{"in sync", "role:slave\r\nmaster_link_status:up\r\nslave_repl_offset:4990\r\n", ""},
+		{"link down", "role:slave\r\nmaster_link_status:down\r\nslave_repl_offset:5000\r\n", "link to the master down"},
+		{"lagging", "role:slave\r\nmaster_link_status:up\r\nslave_repl_offset:3000\r\n", "2000 bytes behind"},
+		{"not a replica", "role:master\r\nmaster_repl_offset:0\r\n", "not a replica"},
+		{"no link status", "role:slave\r\nslave_repl_offset:5000\r\n", "no link status"},
+		{"no offset", "role:slave\r\nmaster_link_status:up\r\n", "no replication offset"},
+	}
+	for _, tt := range tests {
+		got := followerProblem(master, parseInfo(tt.follower), 1000)
+		if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
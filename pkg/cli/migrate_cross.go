@@ -0,0 +1,257 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+// Cluster is a product slots are migrated to, possibly registered in
+// another coordinator.
+type Cluster struct {
+	Product  string
+	Store    *models.Store
+	SlotNum  int
+	DataNode *DataNodeConfig
+	// takes the product lock of Product
+	Lock LockClient
+	// Shared is set when Store uses the coordinator client of this cli
+	Shared bool
+}
+
+// ClusterOpener connects to a product with the coordinator and data node
+// settings of a config file or, without one, through the coordinator of
+// this cli.
+type ClusterOpener func(product, configFile string) (*Cluster, error)
+
+// openCluster is set up by loadContext.
+var openCluster ClusterOpener
+
+func localCluster() *Cluster {
+	return &Cluster{
+		Product:  productName,
+		Store:    store,
+		SlotNum:  slotNum,
+		DataNode: dataNode,
+		Lock:     lockClient,
+		Shared:   true,
+	}
+}
+
+func (c *Cluster) Close() error {
+	if c.Shared {
+		return nil
+	}
+	if c.Lock != nil {
+		c.Lock.Close()
+	}
+	return c.Store.Close()
+}
+
+// countStoredSlots returns the number of slots initialized in st.
+func countStoredSlots(st *models.Store) (int, error) {
+	paths, err := st.Client().List(st.SlotDir(), false)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return len(paths), nil
+}
+
+func runCrossMigrate(context *cli.Context) error {
+	toProduct := context.String("to-product")
+	toConfig := context.String("to-config")
+	if !context.IsSet("to-group") {
+		return errors.New("--to-group is required with --to-product")
+	}
+	if toProduct == productName && toConfig == "" {
+		return errors.Errorf("product %s is this product, migrate without --to-product", toProduct)
+	}
+	if openCluster == nil {
+		return errors.New("migrating to another product is not supported by this cli")
+	}
+	fromSlotId, err := strconv.Atoi(context.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("parse fromSlotId err %w", err)
+	}
+	toSlotId, err := strconv.Atoi(context.Args().Get(1))
+	if err != nil {
+		return fmt.Errorf("parse toSlotId err %w", err)
+	}
+	if err := checkSlotRange(fromSlotId, toSlotId); err != nil {
+		return err
+	}
+
+	target, err := openCluster(toProduct, toConfig)
+	if err != nil {
+		return errors.Annotatef(err, "open product %s", toProduct)
+	}
+	defer target.Close()
+	if err := target.DataNode.init(); err != nil {
+		return err
+	}
+	// keys map to the same slot only with the same slot count
+	n, err := countStoredSlots(target.Store)
+	if err != nil {
+		return err
+	}
+	if n != slotNum || target.SlotNum != slotNum {
+		return errors.Errorf("product %s has %d slots (slot_num %d), product %s has %d, keys would map to other slots",
+			toProduct, n, target.SlotNum, productName, slotNum)
+	}
+	toGroup := context.Int("to-group")
+	exists, err := target.Store.GroupExists(toGroup)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !exists {
+		return errors.NotFoundf("group %d of product %s", toGroup, toProduct)
+	}
+
+	t, err := newMigrateTask(fromSlotId, toSlotId, toGroup, context.Int("delay"))
+	if err != nil {
+		return err
+	}
+	t.ToProduct = toProduct
+	if err := checkMigrateSafety(t, target); err != nil {
+		return err
+	}
+
+	impact := []string{
+		fmt.Sprintf("move the keys of slots [%d, %d] of product %s to group %d of product %s",
+			fromSlotId, toSlotId, productName, toGroup, toProduct),
+		fmt.Sprintf("take the slots offline in product %s, they are served by product %s afterwards", productName, toProduct),
+		"DOWNTIME: each slot is offline, its keys can be neither read nor written, until all its keys are copied",
+	}
+	if err := confirm(context, impact); err != nil {
+		return err
+	}
+
+	log.Infof("migrate task %s: slots [%d, %d] to group %d of product %s", t.Id, t.FromSlot, t.ToSlot, toGroup, toProduct)
+	return errors.Trace(RunCrossMigrateTask(t, target))
+}
+
+// RunCrossMigrateTask moves slots to a group of another product, holding
+// the locks of both products. Running the same migration again continues
+// an interrupted one.
+func RunCrossMigrateTask(task *MigrateTask, target *Cluster) error {
+	onLost := func() { task.stop(ErrProductLockLost) }
+	unlock, err := lockProduct(onLost)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	unlockTarget, err := lockProductIn(target.Store, target.Lock, onLost)
+	if err != nil {
+		return errors.Annotatef(err, "lock product %s", target.Product)
+	}
+	defer unlockTarget()
+
+	task.setStatus(MIGRATE_TASK_MIGRATING)
+	migrateTaskPercent.Set(float64(task.Percent))
+	for slotId := task.FromSlot; slotId <= task.ToSlot; slotId++ {
+		err := task.stopReason()
+		if err == nil {
+			err = migrateSlotToCluster(task, slotId, target)
+		}
+		if task.stopReason() == ErrProductLockLost {
+			err = ErrProductLockLost
+		}
+		if errors.Cause(err) == ErrStopMigrateByUser {
+			log.Info("stop migration job by user")
+			task.setStatus(MIGRATE_TASK_PAUSED)
+			return err
+		} else if err != nil {
+			log.Error(err)
+			task.setStatus(MIGRATE_TASK_ERR)
+			return err
+		}
+		task.Percent = (slotId - task.FromSlot + 1) * 100 / (task.ToSlot - task.FromSlot + 1)
+		task.setStatus(MIGRATE_TASK_MIGRATING)
+		migrateTaskPercent.Set(float64(task.Percent))
+		log.Info("total percent:", task.Percent)
+	}
+	task.setStatus(MIGRATE_TASK_FINISHED)
+	log.Info("migration finished")
+	return nil
+}
+
+// migrateSlotToCluster moves one slot. The target slot is assigned to the
+// target group but kept offline, the source slot goes offline so that no
+// write is lost, then the data moves and the target slot goes online. The
+// slot is never served by both products, but it is not served at all
+// while its keys are copied.
+func migrateSlotToCluster(task *MigrateTask, slotId int, target *Cluster) error {
+	to := task.NewGroupId
+	s, err := store.GetSlot(slotId, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ts, err := target.Store.GetSlot(slotId, true)
+	if err != nil {
+		return errors.Annotatef(err, "slot %d of product %s", slotId, target.Product)
+	}
+
+	reserved := ts.State.Status == models.SLOT_STATUS_OFFLINE && ts.GroupId == to
+	switch {
+	case s.State.Status == models.SLOT_STATUS_OFFLINE && ts.State.Status == models.SLOT_STATUS_ONLINE && ts.GroupId == to:
+		log.Infof("slot %d is already served by group %d of product %s, skip", slotId, to, target.Product)
+		return nil
+	case ts.State.Status == models.SLOT_STATUS_ONLINE:
+		return errors.Errorf("slot %d of product %s is online on group %d", slotId, target.Product, ts.GroupId)
+	case ts.State.Status != models.SLOT_STATUS_OFFLINE:
+		return errors.Errorf("slot %d of product %s is %s", slotId, target.Product, ts.State.Status)
+	case ts.GroupId != models.INVALID_ID && !reserved:
+		return errors.Errorf("slot %d of product %s is assigned to group %d", slotId, target.Product, ts.GroupId)
+	}
+	switch {
+	case s.State.Status == models.SLOT_STATUS_ONLINE:
+	case s.State.Status == models.SLOT_STATUS_OFFLINE && reserved:
+		log.Infof("continue interrupted migration of slot %d to product %s", slotId, target.Product)
+	default:
+		return errors.Errorf("slot %d is %s, only online slots move to another product", slotId, s.State.Status)
+	}
+	from := s.GroupId
+	if from == models.INVALID_ID {
+		return errors.Errorf("slot %d is not assigned to any group", slotId)
+	}
+
+	log.Infof("start migrate slot %d to group %d of product %s", slotId, to, target.Product)
+	task.setSlotStatus(slotId, from, MIGRATE_TASK_MIGRATING)
+	if err := saveMigrateTask(task); err != nil {
+		return err
+	}
+	ts.GroupId = to
+	if err := target.Store.UpdateSlot(ts); err != nil {
+		migrateErrorsTotal.WithLabelValues("set_migrate_status").Inc()
+		return errors.Annotatef(err, "assign slot %d of product %s", slotId, target.Product)
+	}
+	s.State.Status = models.SLOT_STATUS_OFFLINE
+	if err := store.UpdateSlot(s); err != nil {
+		migrateErrorsTotal.WithLabelValues("set_migrate_status").Inc()
+		return errors.Annotatef(err, "take slot %d offline", slotId)
+	}
+
+	if err := migrateSlotData(slotId, from, target, to, task.Delay, task.stopChan); err != nil {
+		if errors.Cause(err) != ErrStopMigrateByUser {
+			migrateErrorsTotal.WithLabelValues("migrate").Inc()
+			task.setSlotStatus(slotId, from, MIGRATE_TASK_ERR)
+		}
+		return err
+	}
+
+	if err := setSlotOnlineIn(target.Store, ts, to); err != nil {
+		migrateErrorsTotal.WithLabelValues("set_online").Inc()
+		return errors.Annotatef(err, "bring slot %d of product %s online", slotId, target.Product)
+	}
+	migrateSlotsTotal.Inc()
+	task.setSlotStatus(slotId, from, MIGRATE_TASK_FINISHED)
+	return nil
+}
@@ -5,14 +5,10 @@ package cli
 
 import (
 	"errors"
-	"fmt"
 	"strings"
 	"time"
 
-	"github.com/IceFireDB/kit/pkg/models"
-	"golang.org/x/net/context"
-
-	log "github.com/IceFireDB/kit/pkg/logger"
+	log "github.com/IceFireDB/cli/pkg/log"
 
 	"github.com/garyburd/redigo/redis"
 	_ "github.com/juju/errors"
@@ -27,6 +23,8 @@ var ErrInvalidAddr = errors.New("invalid addr")
 
 type migrater struct {
 	group string
+	// AUTH args of migratedb for the target data node
+	auth []interface{}
 }
 
 func (m *migrater) nextGroup() {
@@ -66,7 +64,8 @@ func (m *migrater) sendRedisMigrateCmd(c redis.Conn, slotId int, toAddr string)
 	}
 
 	for _, key := range keys {
-		if _, err := c.Do("migrate", addrParts[0], addrParts[1], key, slotId, MIGRATE_TIMEOUT); err != nil {
+		args := append([]interface{}{addrParts[0], addrParts[1], key, slotId, MIGRATE_TIMEOUT}, m.auth...)
+		if _, err := c.Do("migrate", args...); err != nil {
 			// todo, try del if key exists
 			return false, err
 		}
@@ -82,10 +81,15 @@ func (m *migrater) sendLedisMigrateCmd(c redis.Conn, slotId int, toAddr string)
 	}
 
 	count := 10
-	num, err := redis.Int(c.Do("migratedb", addrParts[0], addrParts[1], m.group, count, slotId, MIGRATE_TIMEOUT))
+	start := time.Now()
+	args := append([]interface{}{addrParts[0], addrParts[1], m.group, count, slotId, MIGRATE_TIMEOUT}, m.auth...)
+	num, err := redis.Int(c.Do("migratedb", args...))
+	migratedbDuration.WithLabelValues(m.group).Observe(time.Since(start).Seconds())
 	if err != nil {
 		return false, err
-	} else if num < count {
+	}
+	migrateKeysTotal.WithLabelValues(m.group).Add(float64(num))
+	if num < count {
 		m.nextGroup()
 		return m.group != "", nil
 	} else {
@@ -105,51 +109,29 @@ func (m *migrater) sendMigrateCmd(c redis.Conn, slotId int, toAddr string) (bool
 var ErrStopMigrateByUser = errors.New("migration stop by user")
 
 func MigrateSingleSlot(slotId, fromGroup, toGroup int, delay int, stopChan <-chan struct{}) error {
-	groupFrom, err := store.LoadGroup(fromGroup, true)
-	if err != nil {
-		return fmt.Errorf("load from group err %w", err)
-	}
-	groupTo, err := store.LoadGroup(toGroup, true)
-	if err != nil {
-		return fmt.Errorf("load to group err %w", err)
-	}
-
-	var fromMaster, toMaster *models.Server
-
-	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
-	defer cancel()
-	for fromMaster == nil || toMaster == nil {
-		if ctx.Err() != nil {
-			break
-		}
-		if fromMaster == nil {
-			fromMaster, err = store.Master(groupFrom)
-		}
-		if toMaster == nil {
-			toMaster, err = store.Master(groupTo)
-		}
+	return migrateSlotData(slotId, fromGroup, localCluster(), toGroup, delay, stopChan)
+}
 
-		//toMaster, err = store.Master(groupTo)
-	}
+// migrateSlotData moves the keys of a slot from a group of this product to
+// a group of target.
+func migrateSlotData(slotId, fromGroup int, target *Cluster, toGroup int, delay int, stopChan <-chan struct{}) error {
+	fromMaster, err := waitGroupMaster(store, fromGroup, stopChan)
 	if err != nil {
 		return err
 	}
-
-	if fromMaster == nil || toMaster == nil {
-		return models.ErrGroupMasterNotFound
-	}
-
-	c, err := redis.Dial("tcp", fromMaster.Addr)
+	toMaster, err := waitGroupMaster(target.Store, toGroup, stopChan)
 	if err != nil {
 		return err
 	}
 
-	defer c.Close()
+	sm := newSlotMigration(slotId, fromGroup, target, toGroup, fromMaster.Addr, toMaster.Addr)
+	defer sm.close()
 
 	m := new(migrater)
 	m.group = "KV"
+	m.auth = target.DataNode.migrateAuthArgs()
 
-	remain, err := m.sendMigrateCmd(c, slotId, toMaster.Addr)
+	remain, err := m.sendMigrateCmdRetry(sm, stopChan)
 	if err != nil {
 		return err
 	}
@@ -166,7 +148,10 @@ func MigrateSingleSlot(slotId, fromGroup, toGroup int, delay int, stopChan <-cha
 			default:
 			}
 		}
-		remain, err = m.sendMigrateCmd(c, slotId, toMaster.Addr)
+		if err := sm.refresh(false, stopChan); err != nil {
+			return err
+		}
+		remain, err = m.sendMigrateCmdRetry(sm, stopChan)
 		if num%500 == 0 && remain {
 			log.Infof("still migrating")
 		}
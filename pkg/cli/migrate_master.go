@@ -0,0 +1,237 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/IceFireDB/kit/pkg/models/client"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+const (
+	// how often the masters of a migrating slot are resolved again
+	masterCheckInterval = 5 * time.Second
+	// wait after a master change until the new master is trusted
+	masterChangePause = 2 * time.Second
+
+	defaultMasterWait    = 100 * time.Second
+	masterWaitMinBackoff = 100 * time.Millisecond
+	masterWaitMaxBackoff = 5 * time.Second
+)
+
+var (
+	// how long a migration waits for a group without master
+	masterWait = defaultMasterWait
+	// also wake up on coordinator changes of the servers
+	masterWatch = false
+)
+
+var masterWaitFlags = []cli.Flag{
+	&cli.DurationFlag{
+		Name:  "master-wait",
+		Usage: "how long to wait for a group without master, e.g. during a failover",
+		Value: defaultMasterWait,
+	},
+	&cli.BoolFlag{
+		Name:  "master-watch",
+		Usage: "watch the coordinator while waiting for a master instead of only polling",
+	},
+}
+
+func setMasterWait(c *cli.Context) error {
+	if d := c.Duration("master-wait"); d < 0 {
+		return errors.Errorf("invalid master wait %v", d)
+	}
+	masterWait = c.Duration("master-wait")
+	masterWatch = c.Bool("master-watch")
+	return nil
+}
+
+// describeGroupServers lists the servers of a group with their type as
+// stored in the coordinator.
+func describeGroupServers(st *models.Store, g *models.ServerGroup) string {
+	if len(g.Servers) == 0 {
+		return "no servers"
+	}
+	var servers []string
+	for _, srv := range g.Servers {
+		tp := "unregistered"
+		if s, err := st.GetServer(srv.Addr, false); err == nil && s != nil {
+			tp = string(s.Type)
+		}
+		servers = append(servers, fmt.Sprintf("%s(%s)", srv.Addr, tp))
+	}
+	return "servers " + strings.Join(servers, ", ")
+}
+
+// waitGroupMaster resolves the master of a group of st, polling with backoff
+// for up to masterWait while the group has none.
+func waitGroupMaster(st *models.Store, groupId int, stopChan <-chan struct{}) (*models.Server, error) {
+	deadline := time.Now().Add(masterWait)
+	backoff := masterWaitMinBackoff
+
+	var watch <-chan client.Event
+	for {
+		g, err := st.LoadGroup(groupId, false)
+		if err != nil {
+			return nil, errors.Annotatef(err, "load group %d", groupId)
+		}
+		if g == nil {
+			return nil, errors.NotFoundf("group %d", groupId)
+		}
+		m, err := st.Master(g)
+		if err == nil {
+			return m, nil
+		}
+		if err != models.ErrGroupMasterNotFound {
+			return nil, errors.Annotatef(err, "group %d", groupId)
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, errors.Errorf("group %d has no master after waiting %v, %s",
+				groupId, masterWait, describeGroupServers(st, g))
+		}
+		if backoff < wait {
+			wait = backoff
+		}
+		log.Warnf("group %d has no master, %s, check again in %v", groupId, describeGroupServers(st, g), wait)
+		if masterWatch && watch == nil {
+			if watch, _, err = st.Client().WatchInOrder(st.ServerDir()); err != nil {
+				log.Warnf("watch servers failed: %v", err)
+			}
+		}
+		select {
+		case <-stopChan:
+			return nil, ErrStopMigrateByUser
+		case <-watch:
+			// the watch fires once, set it up again on the next round
+			watch = nil
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > masterWaitMaxBackoff {
+			backoff = masterWaitMaxBackoff
+		}
+	}
+}
+
+// slotMigration is a slot being moved between the masters of two groups.
+// The masters are resolved again while migrating, a failover moves the
+// source connection and the migratedb target to the new masters. The target
+// group may belong to another product.
+type slotMigration struct {
+	slotId    int
+	fromGroup int
+	toGroup   int
+	target    *Cluster
+
+	// master addrs
+	from string
+	to   string
+
+	conn    *retryConn
+	checked time.Time
+}
+
+func newSlotMigration(slotId, fromGroup int, target *Cluster, toGroup int, from, to string) *slotMigration {
+	return &slotMigration{
+		slotId:    slotId,
+		fromGroup: fromGroup,
+		toGroup:   toGroup,
+		target:    target,
+		from:      from,
+		to:        to,
+		conn:      &retryConn{addr: from},
+		checked:   time.Now(),
+	}
+}
+
+func (sm *slotMigration) close() {
+	sm.conn.reset()
+}
+
+// resolveGroupMaster returns the current master of a group of st. The
+// error is fatal when the group is gone.
+func resolveGroupMaster(st *models.Store, groupId, slotId int) (*models.Server, error) {
+	exists, err := st.GroupExists(groupId)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !exists {
+		return nil, &MigrateError{
+			Class: MIGRATE_ERR_GROUP_GONE,
+			Err:   errors.NotFoundf("group %d, removed while migrating slot %d, run `slot repair`", groupId, slotId),
+		}
+	}
+	g, err := st.LoadGroup(groupId, true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return st.Master(g)
+}
+
+func (sm *slotMigration) resolve() (string, string, error) {
+	from, err := resolveGroupMaster(store, sm.fromGroup, sm.slotId)
+	if err != nil {
+		return "", "", err
+	}
+	to, err := resolveGroupMaster(sm.target.Store, sm.toGroup, sm.slotId)
+	if err != nil {
+		return "", "", err
+	}
+	return from.Addr, to.Addr, nil
+}
+
+// refresh resolves the masters again, at most every masterCheckInterval
+// unless force is set. On a change it pauses until two lookups in a row
+// agree, then switches over. Only a removed group is an error, a failed
+// lookup keeps the current masters.
+func (sm *slotMigration) refresh(force bool, stopChan <-chan struct{}) error {
+	if !force && time.Since(sm.checked) < masterCheckInterval {
+		return nil
+	}
+	sm.checked = time.Now()
+	from, to, err := sm.resolve()
+	for err == nil && (from != sm.from || to != sm.to) {
+		log.Warnf("masters of slot %d changed: group %d %s -> %s, group %d %s -> %s, pause for %v",
+			sm.slotId, sm.fromGroup, sm.from, from, sm.toGroup, sm.to, to, masterChangePause)
+		select {
+		case <-stopChan:
+			return ErrStopMigrateByUser
+		case <-time.After(masterChangePause):
+		}
+		var nextFrom, nextTo string
+		nextFrom, nextTo, err = sm.resolve()
+		if err != nil || (nextFrom == from && nextTo == to) {
+			break
+		}
+		from, to = nextFrom, nextTo
+	}
+	if err != nil {
+		if merr, ok := err.(*MigrateError); ok && merr.Class == MIGRATE_ERR_GROUP_GONE {
+			return err
+		}
+		log.Warnf("resolve masters of slot %d failed: %v, keep %s -> %s", sm.slotId, err, sm.from, sm.to)
+		return nil
+	}
+
+	if from != sm.from {
+		log.Infof("slot %d: reconnect to new source master %s", sm.slotId, from)
+		sm.conn.reset()
+		sm.conn.addr = from
+		sm.from = from
+	}
+	if to != sm.to {
+		log.Infof("slot %d: redirect migratedb to new target master %s", sm.slotId, to)
+		sm.to = to
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/juju/errors"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+// a migrate plan is an ordered list of migrate tasks
+func loadMigratePlan(file string) ([]MigrateTaskForm, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var plan []MigrateTaskForm
+	if err := json.Unmarshal(b, &plan); err != nil {
+		return nil, errors.Annotatef(err, "parse plan %s", file)
+	}
+	for i, e := range plan {
+		if err := checkSlotRange(e.FromSlot, e.ToSlot); err != nil {
+			return nil, errors.Annotatef(err, "plan entry %d", i)
+		}
+		if err := checkGroupExists(e.NewGroupId); err != nil {
+			return nil, errors.Annotatef(err, "plan entry %d", i)
+		}
+	}
+	return plan, nil
+}
+
+func encodeMigratePlan(plan []MigrateTaskForm) []byte {
+	b, _ := json.MarshalIndent(plan, "", "  ")
+	return append(b, '\n')
+}
+
+const (
+	PLAN_ON_ERROR_STOP     string = "stop"
+	PLAN_ON_ERROR_CONTINUE string = "continue"
+)
+
+// MigratePlanResult is the outcome of a plan entry. The report of a run is
+// a plan itself, running it again skips the finished entries.
+type MigratePlanResult struct {
+	Entry int `json:"entry"`
+	MigrateTaskForm
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// runMigratePlan runs the entries in order. A failed entry stops the plan
+// unless onError is continue, but a slot left in migrate status always
+// stops it, the next entries would be refused until `slot repair`. The
+// report is written after every entry.
+func runMigratePlan(file string, delay int, onError, report string) error {
+	if onError != PLAN_ON_ERROR_STOP && onError != PLAN_ON_ERROR_CONTINUE {
+		return errors.Errorf("invalid --on-error %q, should be one of (stop, continue)", onError)
+	}
+	plan, err := loadMigratePlan(file)
+	if err != nil {
+		return err
+	}
+	return runMigratePlanEntries(plan, delay, onError, report)
+}
+
+func runMigratePlanEntries(plan []MigrateTaskForm, delay int, onError, report string) error {
+	results := make([]*MigratePlanResult, len(plan))
+	for i, e := range plan {
+		if e.Status != MIGRATE_TASK_FINISHED {
+			e.Status = MIGRATE_TASK_PENDING
+		}
+		results[i] = &MigratePlanResult{Entry: i, MigrateTaskForm: e}
+	}
+
+	failed := 0
+	for i, r := range results {
+		if r.Status == MIGRATE_TASK_FINISHED {
+			log.Infof("plan entry %d/%d already finished by task %s, skip", i+1, len(plan), r.Id)
+			continue
+		}
+		if r.Delay == 0 {
+			r.Delay = delay
+		}
+		log.Infof("plan entry %d/%d: slots [%d, %d] to group %d", i+1, len(plan), r.FromSlot, r.ToSlot, r.NewGroupId)
+		start := time.Now()
+		err := runMigratePlanEntry(r)
+		r.Duration = time.Since(start).Truncate(time.Millisecond).String()
+		paused := false
+		switch errors.Cause(err) {
+		case nil:
+		case ErrStopMigrateByUser, ErrMigrateWindowClosed:
+			// the task is saved as paused, resume it or run the plan again
+			paused = true
+			r.Status = MIGRATE_TASK_PAUSED
+			r.Error = err.Error()
+			log.Warnf("plan entry %d/%d paused: %v", i+1, len(plan), err)
+		default:
+			failed++
+			r.Status = MIGRATE_TASK_ERR
+			r.Error = err.Error()
+			log.Errorf("plan entry %d/%d failed: %v", i+1, len(plan), err)
+		}
+		if err := writeMigratePlanReport(report, results); err != nil {
+			return err
+		}
+		if err == nil {
+			continue
+		}
+		if paused {
+			break
+		}
+		if onError == PLAN_ON_ERROR_STOP {
+			break
+		}
+		if slots, err := store.GetMigratingSlots(); err != nil {
+			return errors.Trace(err)
+		} else if len(slots) > 0 {
+			r.Error += fmt.Sprintf("; slot %d is left in migrate status, the rest of the plan is not run, see `slot repair`", slots[0].Id)
+			log.Errorf("slot %d is left in migrate status, stop the plan", slots[0].Id)
+			if err := writeMigratePlanReport(report, results); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	printMigratePlanReport(results)
+	if report != "" {
+		log.Infof("plan report written to %s", report)
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d plan entries failed", failed, len(plan))
+	}
+	for _, r := range results {
+		if r.Status == MIGRATE_TASK_PAUSED {
+			return errors.Errorf("plan paused at entry %d, run it again to continue", r.Entry+1)
+		}
+	}
+	return nil
+}
+
+func runMigratePlanEntry(r *MigratePlanResult) error {
+	t, err := newMigrateTask(r.FromSlot, r.ToSlot, r.NewGroupId, r.Delay)
+	if err != nil {
+		return err
+	}
+	err = runMigrate(t)
+	r.MigrateTaskForm = t.MigrateTaskForm
+	return err
+}
+
+// writeMigratePlanReport replaces the report, so that it is complete up to
+// the last entry even if the cli is killed.
+func writeMigratePlanReport(report string, results []*MigratePlanResult) error {
+	if report == "" {
+		return nil
+	}
+	b, _ := json.MarshalIndent(results, "", "  ")
+	tmp := report + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return errors.Annotatef(err, "write report %s", report)
+	}
+	return errors.Annotatef(os.Rename(tmp, report), "write report %s", report)
+}
+
+func printMigratePlanReport(results []*MigratePlanResult) {
+	count := make(map[string]int)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ENTRY\tSLOTS\tGROUP\tSTATUS\tTASK\tDURATION\tERROR")
+	for _, r := range results {
+		count[r.Status]++
+		fmt.Fprintf(w, "%d\t%d-%d\t%d\t%s\t%s\t%s\t%s\n", r.Entry+1, r.FromSlot, r.ToSlot, r.NewGroupId,
+			r.Status, r.Id, r.Duration, r.Error)
+	}
+	_ = w.Flush()
+	fmt.Printf("%d entries: %d finished, %d failed, %d paused, %d not run\n", len(results),
+		count[MIGRATE_TASK_FINISHED], count[MIGRATE_TASK_ERR], count[MIGRATE_TASK_PAUSED], count[MIGRATE_TASK_PENDING])
+}
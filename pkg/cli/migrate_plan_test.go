@@ -0,0 +1,104 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IceFireDB/kit/pkg/models"
+)
+
+func setTestSlot(t *testing.T, id, groupId int, migrateFrom int) {
+	t.Helper()
+	s := models.NewSlot(productName, id)
+	s.GroupId = groupId
+	s.State.Status = models.SLOT_STATUS_ONLINE
+	if migrateFrom != models.INVALID_ID {
+		s.State.Status = models.SLOT_STATUS_MIGRATE
+		s.State.MigrateStatus.From = migrateFrom
+		s.State.MigrateStatus.To = groupId
+	}
+	if err := store.UpdateSlotWithoutAction(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunMigratePlan(t *testing.T) {
+	// slot 0 is on group 1 which has no master, moving it fails before
+	// any key moves, slots 1 and 2 are on group 2 already
+	fails := MigrateTaskForm{FromSlot: 0, ToSlot: 0, NewGroupId: 2}
+	noop := MigrateTaskForm{FromSlot: 1, ToSlot: 2, NewGroupId: 2}
+	done := MigrateTaskForm{FromSlot: 1, ToSlot: 1, NewGroupId: 2, Status: MIGRATE_TASK_FINISHED, Id: "done"}
+	tests := []struct {
+		name      string
+		plan      []MigrateTaskForm
+		onError   string
+		migrating bool
+		want      []string
+		wantErr   bool
+	}{
+		{"stop", []MigrateTaskForm{fails, noop}, PLAN_ON_ERROR_STOP, false,
+			[]string{MIGRATE_TASK_ERR, MIGRATE_TASK_PENDING}, true},
+		{"continue", []MigrateTaskForm{fails, noop}, PLAN_ON_ERROR_CONTINUE, false,
+			[]string{MIGRATE_TASK_ERR, MIGRATE_TASK_FINISHED}, true},
+		{"rerun skips finished", []MigrateTaskForm{done, noop}, PLAN_ON_ERROR_STOP, false,
+			[]string{MIGRATE_TASK_FINISHED, MIGRATE_TASK_FINISHED}, false},
+		{"continue stops at a migrating slot", []MigrateTaskForm{fails, noop}, PLAN_ON_ERROR_CONTINUE, true,
+			[]string{MIGRATE_TASK_ERR, MIGRATE_TASK_PENDING}, true},
+	}
+	for _, tt := range tests {
+		useMemStore(t, 4)
+		addTestServer(t, 1, "127.0.0.1:1", models.ServerTypeFollower)
+		addTestServer(t, 2, "127.0.0.1:2", models.ServerTypeLeader)
+		setTestSlot(t, 0, 1, models.INVALID_ID)
+		setTestSlot(t, 1, 2, models.INVALID_ID)
+		setTestSlot(t, 2, 2, models.INVALID_ID)
+		if tt.migrating {
+			setTestSlot(t, 3, 2, 1)
+		} else {
+			setTestSlot(t, 3, 1, models.INVALID_ID)
+		}
+
+		dir := t.TempDir()
+		file, report := filepath.Join(dir, "plan.json"), filepath.Join(dir, "report.json")
+		if err := ioutil.WriteFile(file, encodeMigratePlan(tt.plan), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := runMigratePlan(file, 0, tt.onError, report)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+
+		b, err := ioutil.ReadFile(report)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var results []MigratePlanResult
+		if err := json.Unmarshal(b, &results); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(results) != len(tt.want) {
+			t.Fatalf("%s: %d results, want %d", tt.name, len(results), len(tt.want))
+		}
+		for i, r := range results {
+			if r.Status != tt.want[i] {
+				t.Errorf("%s: entry %d is %s (%s), want %s", tt.name, i, r.Status, r.Error, tt.want[i])
+			}
+		}
+		if tt.migrating && !strings.Contains(results[0].Error, "slot 3 is left in migrate status") {
+			t.Errorf("%s: error of entry 0 %q does not name the migrating slot", tt.name, results[0].Error)
+		}
+		if results[0].Id == "" {
+			t.Errorf("%s: entry 0 has no task id", tt.name)
+		}
+		// the report is a plan itself
+		if _, err := loadMigratePlan(report); err != nil {
+			t.Errorf("%s: load report as plan: %v", tt.name, err)
+		}
+	}
+}
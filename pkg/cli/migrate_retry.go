@@ -0,0 +1,208 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	goerrors "errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+const (
+	MIGRATE_ERR_NETWORK     string = "network"
+	MIGRATE_ERR_TIMEOUT     string = "timeout"
+	MIGRATE_ERR_TARGET_FULL string = "target_full"
+	MIGRATE_ERR_PROTOCOL    string = "protocol"
+	MIGRATE_ERR_GROUP_GONE  string = "group_gone"
+)
+
+const (
+	defaultMigrateRetries    = 5
+	defaultMigrateBackoff    = 500 * time.Millisecond
+	defaultMigrateMaxBackoff = 30 * time.Second
+)
+
+// MigrateError is a failed migratedb call with the class of its cause.
+// Network errors and timeouts are retried, a full target or an unexpected
+// reply ends the task.
+type MigrateError struct {
+	Class string
+	Err   error
+}
+
+func (e *MigrateError) Error() string {
+	return fmt.Sprintf("%s error: %v", e.Class, e.Err)
+}
+
+func (e *MigrateError) Unwrap() error {
+	return e.Err
+}
+
+func (e *MigrateError) Retryable() bool {
+	return e.Class == MIGRATE_ERR_NETWORK || e.Class == MIGRATE_ERR_TIMEOUT
+}
+
+func classifyMigrateError(err error) *MigrateError {
+	if merr, ok := err.(*MigrateError); ok {
+		return merr
+	}
+	cause := errors.Cause(err)
+	class := MIGRATE_ERR_PROTOCOL
+	switch e := cause.(type) {
+	case redis.Error:
+		// error reply of the source, which may come from its own
+		// connection to the target
+		msg := strings.ToLower(string(e))
+		switch {
+		case strings.Contains(msg, "oom"), strings.Contains(msg, "maxmemory"),
+			strings.Contains(msg, "no space"), strings.Contains(msg, "full"):
+			class = MIGRATE_ERR_TARGET_FULL
+		case strings.Contains(msg, "timeout"), strings.Contains(msg, "timed out"):
+			class = MIGRATE_ERR_TIMEOUT
+		case strings.Contains(msg, "connection"), strings.Contains(msg, "broken pipe"):
+			class = MIGRATE_ERR_NETWORK
+		}
+	case net.Error:
+		class = MIGRATE_ERR_NETWORK
+		if e.Timeout() {
+			class = MIGRATE_ERR_TIMEOUT
+		}
+	default:
+		switch {
+		case cause == io.EOF, cause == io.ErrUnexpectedEOF,
+			goerrors.Is(cause, syscall.ECONNRESET), goerrors.Is(cause, syscall.ECONNREFUSED),
+			goerrors.Is(cause, syscall.EPIPE):
+			class = MIGRATE_ERR_NETWORK
+		}
+	}
+	return &MigrateError{Class: class, Err: err}
+}
+
+type retryPolicy struct {
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// migrateRetry applies to every migratedb call of the running command.
+var migrateRetry = retryPolicy{
+	retries:    defaultMigrateRetries,
+	backoff:    defaultMigrateBackoff,
+	maxBackoff: defaultMigrateMaxBackoff,
+}
+
+var retryFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:  "retries",
+		Usage: "retries of a migratedb call failing with a network error or timeout, 0 to fail at once",
+		Value: defaultMigrateRetries,
+	},
+	&cli.DurationFlag{
+		Name:  "retry-backoff",
+		Usage: "wait before the first retry, doubled after every failed retry",
+		Value: defaultMigrateBackoff,
+	},
+	&cli.DurationFlag{
+		Name:  "retry-max-backoff",
+		Usage: "upper bound of the wait between retries",
+		Value: defaultMigrateMaxBackoff,
+	},
+}
+
+// migrateFlags are the options of every command moving slot data.
+var migrateFlags = append(append(append([]cli.Flag{}, retryFlags...), masterWaitFlags...), lockFlags...)
+
+func setMigrateOptions(c *cli.Context) error {
+	if err := setRetryPolicy(c); err != nil {
+		return err
+	}
+	if err := setLockWait(c); err != nil {
+		return err
+	}
+	return setMasterWait(c)
+}
+
+func setRetryPolicy(c *cli.Context) error {
+	p := retryPolicy{
+		retries:    c.Int("retries"),
+		backoff:    c.Duration("retry-backoff"),
+		maxBackoff: c.Duration("retry-max-backoff"),
+	}
+	if p.retries < 0 || p.backoff < 0 || p.maxBackoff < p.backoff {
+		return errors.Errorf("invalid retry policy: retries %d, backoff %v, max backoff %v", p.retries, p.backoff, p.maxBackoff)
+	}
+	migrateRetry = p
+	return nil
+}
+
+// retryConn is a connection to a data node that is dialed again after
+// a failure, redigo connections are unusable once they saw an I/O error.
+type retryConn struct {
+	addr string
+	c    redis.Conn
+}
+
+func (rc *retryConn) get() (redis.Conn, error) {
+	if rc.c == nil {
+		c, err := dialServer(rc.addr)
+		if err != nil {
+			return nil, err
+		}
+		rc.c = c
+	}
+	return rc.c, nil
+}
+
+func (rc *retryConn) reset() {
+	if rc.c != nil {
+		rc.c.Close()
+		rc.c = nil
+	}
+}
+
+// sendMigrateCmdRetry sends one migratedb batch, retrying network errors and
+// timeouts with exponential backoff on a new connection. The masters are
+// resolved again before every retry since a failover looks like a network
+// error.
+func (m *migrater) sendMigrateCmdRetry(sm *slotMigration, stopChan <-chan struct{}) (bool, error) {
+	backoff := migrateRetry.backoff
+	for attempt := 0; ; attempt++ {
+		c, err := sm.conn.get()
+		if err == nil {
+			var remain bool
+			if remain, err = m.sendMigrateCmd(c, sm.slotId, sm.to); err == nil {
+				return remain, nil
+			}
+		}
+		merr := classifyMigrateError(err)
+		if !merr.Retryable() || attempt >= migrateRetry.retries {
+			return false, merr
+		}
+		migrateRetriesTotal.WithLabelValues(merr.Class).Inc()
+		sm.conn.reset()
+		log.Warnf("migrate slot %d (%s) from %s to %s: %v, retry %d/%d in %v",
+			sm.slotId, m.group, sm.from, sm.to, merr, attempt+1, migrateRetry.retries, backoff)
+		select {
+		case <-stopChan:
+			return false, ErrStopMigrateByUser
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > migrateRetry.maxBackoff {
+			backoff = migrateRetry.maxBackoff
+		}
+		if err := sm.refresh(true, stopChan); err != nil {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/juju/errors"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+// preRollbackCheck allows the rollback only when the migrating slots, if
+// any, belong to the task being rolled back.
+func preRollbackCheck(task *MigrateTask) error {
+	slots, err := store.GetMigratingSlots()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, s := range slots {
+		if s.State.MigrateStatus.To != task.NewGroupId || !task.hasSlot(s.Id) {
+			return errors.Errorf("there is a migrating slot %+v not belonging to task %s, finish it first or run `slot repair`", s, task.Id)
+		}
+	}
+	return nil
+}
+
+func (t *MigrateTask) hasSlot(slotId int) bool {
+	for _, s := range t.Slots {
+		if s.SlotId == slotId {
+			return true
+		}
+	}
+	return false
+}
+
+// RunRollbackTask migrates the slots moved by task back to the groups they
+// were taken from, newest first.
+func RunRollbackTask(task *MigrateTask, delay int) error {
+	if task.ToProduct != "" {
+		return errors.Errorf("migrate task %s moved slots to product %s, migrate them back from there", task.Id, task.ToProduct)
+	}
+	if task.Status == MIGRATE_TASK_ROLLED_BACK {
+		return errors.Errorf("migrate task %s is already rolled back", task.Id)
+	}
+	if err := preRollbackCheck(task); err != nil {
+		return err
+	}
+
+	stopChan := make(chan struct{})
+	unlock, err := lockProduct(func() { close(stopChan) })
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for i := len(task.Slots) - 1; i >= 0; i-- {
+		rec := &task.Slots[i]
+		if rec.Status == MIGRATE_TASK_ROLLED_BACK {
+			continue
+		}
+		select {
+		case <-stopChan:
+			task.setStatus(MIGRATE_TASK_ERR)
+			return ErrProductLockLost
+		default:
+		}
+		s, err := store.GetSlot(rec.SlotId, true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		switch {
+		case s.State.Status == models.SLOT_STATUS_ONLINE && s.GroupId == rec.From:
+			// never left the source group
+			rec.Status = MIGRATE_TASK_ROLLED_BACK
+			continue
+		case s.State.Status == models.SLOT_STATUS_MIGRATE && s.State.MigrateStatus.To == task.NewGroupId:
+			// interrupted in the middle of the slot, keys are on both sides
+		case s.State.Status == models.SLOT_STATUS_ONLINE && s.GroupId == task.NewGroupId:
+		default:
+			log.Warnf("slot %d was changed after task %s (group %d, status %s), skip it",
+				s.Id, task.Id, s.GroupId, s.State.Status)
+			continue
+		}
+
+		exists, err := store.GroupExists(rec.From)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !exists {
+			return errors.NotFoundf("source group %d of slot %d", rec.From, rec.SlotId)
+		}
+
+		log.Infof("roll back slot %d from group %d to group %d", rec.SlotId, task.NewGroupId, rec.From)
+		if err := migrateSlot(s, task.NewGroupId, rec.From, delay, stopChan); err != nil {
+			task.setStatus(MIGRATE_TASK_ERR)
+			if errors.Cause(err) == ErrStopMigrateByUser {
+				return ErrProductLockLost
+			}
+			return err
+		}
+		rec.Status = MIGRATE_TASK_ROLLED_BACK
+		task.setStatus(task.Status)
+	}
+	task.setStatus(MIGRATE_TASK_ROLLED_BACK)
+	log.Info("rollback finished")
+	return nil
+}
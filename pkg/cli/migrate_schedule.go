@@ -0,0 +1,175 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+// ErrMigrateWindowClosed pauses a task between two slots.
+var ErrMigrateWindowClosed = errors.New("migrate window closed")
+
+var migrateAtLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+}
+
+// parseMigrateAt parses the start time of a scheduled task, a date and
+// time or only a local time of day, which means its next occurrence.
+func parseMigrateAt(s string, now time.Time) (time.Time, error) {
+	for _, layout := range migrateAtLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	d, err := parseTimeOfDay(s)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid start time %q, use e.g. 01:30 or 2006-01-02 01:30", s)
+	}
+	t := midnight(now).Add(d)
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func midnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// migrateWindow is a daily maintenance window in local time, it may span
+// midnight, e.g. 23:00-02:00.
+type migrateWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+func parseMigrateWindow(s string) (*migrateWindow, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid window %q, use e.g. 01:00-05:00", s)
+	}
+	start, err := parseTimeOfDay(parts[0])
+	if err != nil {
+		return nil, errors.Errorf("invalid window %q, use e.g. 01:00-05:00", s)
+	}
+	end, err := parseTimeOfDay(parts[1])
+	if err != nil {
+		return nil, errors.Errorf("invalid window %q, use e.g. 01:00-05:00", s)
+	}
+	if start == end {
+		return nil, errors.Errorf("invalid window %q, empty", s)
+	}
+	return &migrateWindow{start: start, end: end}, nil
+}
+
+// next returns the window open at now, or else the next one.
+func (w *migrateWindow) next(now time.Time) (time.Time, time.Time) {
+	day := midnight(now).AddDate(0, 0, -1)
+	for {
+		opens, closes := day.Add(w.start), day.Add(w.end)
+		if w.end < w.start {
+			closes = closes.AddDate(0, 0, 1)
+		}
+		if now.Before(closes) {
+			return opens, closes
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+}
+
+func (t *MigrateTask) schedule() (*migrateWindow, error) {
+	if t.Window == "" {
+		return nil, nil
+	}
+	return parseMigrateWindow(t.Window)
+}
+
+// nextRun returns when the task may run and, with a window, when it has to
+// pause again.
+func (t *MigrateTask) nextRun(w *migrateWindow, now time.Time) (time.Time, time.Time) {
+	start := now
+	if t.StartAt > 0 && time.Unix(t.StartAt, 0).After(now) {
+		start = time.Unix(t.StartAt, 0)
+	}
+	if w == nil {
+		return start, time.Time{}
+	}
+	opens, closes := w.next(start)
+	if opens.After(start) {
+		start = opens
+	}
+	return start, closes
+}
+
+// runScheduledMigrate runs a task at its start time and only within its
+// window. When the window closes, the task pauses once the current slot
+// is done and continues when the window opens the next time. The task is
+// saved while waiting, `slot migrate --resume` picks it up after a restart.
+func runScheduledMigrate(t *MigrateTask) error {
+	w, err := t.schedule()
+	if err != nil {
+		return err
+	}
+	for {
+		start, closes := t.nextRun(w, time.Now())
+		if wait := time.Until(start); wait > 0 {
+			if t.Status != MIGRATE_TASK_PAUSED {
+				t.setStatus(MIGRATE_TASK_SCHEDULED)
+			}
+			log.Infof("migrate task %s (%s) waits %v until %s",
+				t.Id, t.Status, wait.Truncate(time.Second), start.Format(time.RFC3339))
+			time.Sleep(wait)
+			continue
+		}
+
+		t.stopMu.Lock()
+		t.stopChan, t.stopErr, t.windowClosed = make(chan struct{}), nil, false
+		t.stopMu.Unlock()
+		var timer *time.Timer
+		if w != nil {
+			timer = time.AfterFunc(time.Until(closes), func() {
+				log.Infof("window %s of migrate task %s closed, pause after the current slot", t.Window, t.Id)
+				t.closeWindow(true)
+			})
+		}
+		err := runMigrate(t)
+		if timer != nil {
+			timer.Stop()
+		}
+		if w != nil && errors.Cause(err) == ErrMigrateWindowClosed {
+			continue
+		}
+		return err
+	}
+}
+
+// describeSchedule is shown with the task.
+func (t *MigrateTask) describeSchedule() string {
+	var s []string
+	if t.StartAt > 0 {
+		s = append(s, "at "+formatUnix(t.StartAt))
+	}
+	if t.Window != "" {
+		s = append(s, fmt.Sprintf("window %s", t.Window))
+	}
+	return strings.Join(s, ", ")
+}
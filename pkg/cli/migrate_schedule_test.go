@@ -0,0 +1,105 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+func localTime(s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParseMigrateAt(t *testing.T) {
+	now := localTime("2021-10-01 12:00")
+	tests := []struct {
+		in   string
+		want string
+		bad  bool
+	}{
+		{in: "2021-10-02 01:30", want: "2021-10-02 01:30"},
+		{in: "2021-10-02T01:30", want: "2021-10-02 01:30"},
+		{in: "13:00", want: "2021-10-01 13:00"},
+		// a time of day already past is tomorrow
+		{in: "01:30", want: "2021-10-02 01:30"},
+		{in: "12:00", want: "2021-10-02 12:00"},
+		{in: "25:00", bad: true},
+		{in: "tomorrow", bad: true},
+	}
+	for _, tt := range tests {
+		got, err := parseMigrateAt(tt.in, now)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("%q: parsed as %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+		} else if !got.Equal(localTime(tt.want)) {
+			t.Errorf("%q: %v, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMigrateWindowNext(t *testing.T) {
+	tests := []struct {
+		window string
+		now    string
+		opens  string
+		closes string
+	}{
+		{"01:00-05:00", "2021-10-01 00:30", "2021-10-01 01:00", "2021-10-01 05:00"},
+		{"01:00-05:00", "2021-10-01 03:00", "2021-10-01 01:00", "2021-10-01 05:00"},
+		{"01:00-05:00", "2021-10-01 05:00", "2021-10-02 01:00", "2021-10-02 05:00"},
+		{"01:00-05:00", "2021-10-01 12:00", "2021-10-02 01:00", "2021-10-02 05:00"},
+		// crossing midnight
+		{"23:00-02:00", "2021-10-01 12:00", "2021-10-01 23:00", "2021-10-02 02:00"},
+		{"23:00-02:00", "2021-10-01 23:30", "2021-10-01 23:00", "2021-10-02 02:00"},
+		{"23:00-02:00", "2021-10-02 01:00", "2021-10-01 23:00", "2021-10-02 02:00"},
+		{"23:00-02:00", "2021-10-02 02:00", "2021-10-02 23:00", "2021-10-03 02:00"},
+	}
+	for _, tt := range tests {
+		w, err := parseMigrateWindow(tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opens, closes := w.next(localTime(tt.now))
+		if !opens.Equal(localTime(tt.opens)) || !closes.Equal(localTime(tt.closes)) {
+			t.Errorf("window %s at %s: %v - %v, want %s - %s", tt.window, tt.now, opens, closes, tt.opens, tt.closes)
+		}
+	}
+	for _, s := range []string{"01:00", "01:00-01:00", "01:00-5"} {
+		if _, err := parseMigrateWindow(s); err == nil {
+			t.Errorf("window %q accepted", s)
+		}
+	}
+}
+
+func TestRunMigrateTaskWindowClosed(t *testing.T) {
+	useMemStore(t, 4)
+	task, err := newMigrateTask(0, 3, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.Window = "01:00-05:00"
+	task.closeWindow(true)
+	if err := RunMigrateTask(task); errors.Cause(err) != ErrMigrateWindowClosed {
+		t.Fatalf("RunMigrateTask: %v, want %v", err, ErrMigrateWindowClosed)
+	}
+	saved, err := loadMigrateTask(task.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != MIGRATE_TASK_PAUSED || len(saved.Slots) != 0 {
+		t.Errorf("task %s with slots %v, want paused before the first slot", saved.Status, saved.Slots)
+	}
+}
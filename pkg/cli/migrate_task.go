@@ -5,12 +5,15 @@ package cli
 
 import (
 	"container/list"
+	"encoding/json"
+	"path"
+	"sort"
 	"sync"
 
 	"github.com/IceFireDB/kit/pkg/models"
 	"github.com/juju/errors"
 
-	log "github.com/IceFireDB/kit/pkg/logger"
+	log "github.com/IceFireDB/cli/pkg/log"
 )
 
 var (
@@ -24,23 +27,84 @@ const (
 	MIGRATE_TASK_MIGRATING string = "migrating"
 	MIGRATE_TASK_FINISHED  string = "finished"
 	MIGRATE_TASK_ERR       string = "error"
+	MIGRATE_TASK_SCHEDULED string = "scheduled"
+	MIGRATE_TASK_PAUSED    string = "paused"
+
+	MIGRATE_TASK_ROLLED_BACK string = "rolled_back"
 )
 
+// MigrateSlotForm records where a slot of a task came from, so the task can
+// be rolled back.
+type MigrateSlotForm struct {
+	SlotId int    `json:"slot"`
+	From   int    `json:"from"`
+	Status string `json:"status"`
+}
+
 type MigrateTaskForm struct {
 	FromSlot   int    `json:"from"`
 	ToSlot     int    `json:"to"`
 	NewGroupId int    `json:"new_group"`
 	Delay      int    `json:"delay"`
-	CreateAt   string `json:"create_at"`
-	Percent    int    `json:"percent"`
-	Status     string `json:"status"`
-	Id         string `json:"id"`
+	CreateAt   string `json:"create_at,omitempty"`
+	Percent    int    `json:"percent,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Id         string `json:"id,omitempty"`
+
+	// not before StartAt (unix time), only within Window (e.g. 01:00-05:00)
+	StartAt int64  `json:"start_at,omitempty"`
+	Window  string `json:"window,omitempty"`
+	// set when the slots move to another product
+	ToProduct string `json:"to_product,omitempty"`
+
+	Slots []MigrateSlotForm `json:"slots,omitempty"`
 }
 
 type MigrateTask struct {
 	MigrateTaskForm
 
+	stopMu   sync.Mutex
 	stopChan chan struct{}
+	// why stopChan was closed by this cli, e.g. ErrProductLockLost
+	stopErr error
+	// set when the window closed, the task pauses before the next slot
+	windowClosed bool
+}
+
+// stop closes stopChan once, the migration stops at its next check.
+func (t *MigrateTask) stop(reason error) {
+	t.stopMu.Lock()
+	defer t.stopMu.Unlock()
+	if t.stopChan == nil {
+		t.stopChan = make(chan struct{})
+	}
+	select {
+	case <-t.stopChan:
+		return
+	default:
+	}
+	t.stopErr = reason
+	close(t.stopChan)
+}
+
+func (t *MigrateTask) stopReason() error {
+	t.stopMu.Lock()
+	defer t.stopMu.Unlock()
+	return t.stopErr
+}
+
+// closeWindow pauses the task once the current slot is done, a slot is
+// never left in migrate status by a window.
+func (t *MigrateTask) closeWindow(closed bool) {
+	t.stopMu.Lock()
+	defer t.stopMu.Unlock()
+	t.windowClosed = closed
+}
+
+func (t *MigrateTask) isWindowClosed() bool {
+	t.stopMu.Lock()
+	defer t.stopMu.Unlock()
+	return t.windowClosed
 }
 
 func findPendingMigrateTask(id string) *MigrateTask {
@@ -64,20 +128,89 @@ func removePendingMigrateTask(id string) bool {
 	return false
 }
 
+func migrateTaskDir() string {
+	return path.Join(models.ProductDir(productName), "migrate_task")
+}
+
+func saveMigrateTask(t *MigrateTask) error {
+	b, err := json.Marshal(t.MigrateTaskForm)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(store.Client().Update(path.Join(migrateTaskDir(), t.Id), b))
+}
+
+func loadMigrateTask(id string) (*MigrateTask, error) {
+	b, err := store.Client().Read(path.Join(migrateTaskDir(), id), false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if b == nil {
+		return nil, errors.NotFoundf("migrate task %s", id)
+	}
+	t := &MigrateTask{}
+	if err := json.Unmarshal(b, &t.MigrateTaskForm); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return t, nil
+}
+
+func listMigrateTasks() ([]*MigrateTask, error) {
+	paths, err := store.Client().List(migrateTaskDir(), false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var tasks []*MigrateTask
+	for _, p := range paths {
+		t, err := loadMigrateTask(path.Base(p))
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].CreateAt < tasks[j].CreateAt
+	})
+	return tasks, nil
+}
+
+// setSlotStatus updates the record of slotId, adding it when missing.
+func (t *MigrateTask) setSlotStatus(slotId, from int, status string) {
+	for i := range t.Slots {
+		if t.Slots[i].SlotId == slotId {
+			t.Slots[i].Status = status
+			return
+		}
+	}
+	t.Slots = append(t.Slots, MigrateSlotForm{SlotId: slotId, From: from, Status: status})
+}
+
+func (t *MigrateTask) setStatus(status string) {
+	t.Status = status
+	if err := saveMigrateTask(t); err != nil {
+		log.Warnf("save migrate task %s failed: %v", t.Id, err)
+	}
+}
+
 // migrate multi slots
 func RunMigrateTask(task *MigrateTask) error {
-	err := store.Lock()
+	unlock, err := lockProduct(func() { task.stop(ErrProductLockLost) })
 	if err != nil {
 		return err
 	}
-	defer func() {
-		_ = store.UnLock()
-	}()
+	defer unlock()
 
 	to := task.NewGroupId
-	task.Status = MIGRATE_TASK_MIGRATING
+	task.setStatus(MIGRATE_TASK_MIGRATING)
+	migrateTaskPercent.Set(float64(task.Percent))
 	for slotId := task.FromSlot; slotId <= task.ToSlot; slotId++ {
 		err := func() error {
+			if err := task.stopReason(); err != nil {
+				return err
+			}
+			if task.isWindowClosed() {
+				return ErrMigrateWindowClosed
+			}
 			log.Info("start migrate slot:", slotId)
 
 			// todo lock for migrate single slot
@@ -120,61 +253,108 @@ func RunMigrateTask(task *MigrateTask) error {
 				return nil
 			}
 
-			// modify slot status
-			if err := store.SetMigrateStatus(s, from, to); err != nil {
-				log.Error(err)
-				return err
-			}
-
-			// do real migrate
-			err = MigrateSingleSlot(slotId, from, to, task.Delay, task.stopChan)
-			if err != nil {
-				log.Error(err)
+			// remember the source before touching the slot
+			task.setSlotStatus(slotId, from, MIGRATE_TASK_MIGRATING)
+			if err := saveMigrateTask(task); err != nil {
 				return err
 			}
-
-			// migrate done, change slot status back
-			s.State.Status = models.SLOT_STATUS_ONLINE
-			s.State.MigrateStatus.From = models.INVALID_ID
-			s.State.MigrateStatus.To = models.INVALID_ID
-			if err := store.UpdateSlot(s); err != nil {
-				log.Error(err)
+			if err := migrateSlot(s, from, to, task.Delay, task.stopChan); err != nil {
+				task.setSlotStatus(slotId, from, MIGRATE_TASK_ERR)
 				return err
 			}
+			task.setSlotStatus(slotId, from, MIGRATE_TASK_FINISHED)
 			return nil
 		}()
-		if err == ErrStopMigrateByUser {
+		if task.stopReason() == ErrProductLockLost {
+			// the slot may be left migrating, the new holder repairs it
+			err = ErrProductLockLost
+		}
+		switch errors.Cause(err) {
+		case nil:
+		case ErrStopMigrateByUser:
 			log.Info("stop migration job by user")
-			break
-		} else if err != nil {
+			task.setStatus(MIGRATE_TASK_PAUSED)
+			return err
+		case ErrMigrateWindowClosed:
+			log.Infof("window %s of migrate task %s closed, pause before slot %d", task.Window, task.Id, slotId)
+			task.setStatus(MIGRATE_TASK_PAUSED)
+			return err
+		default:
 			log.Error(err)
-			task.Status = MIGRATE_TASK_ERR
+			task.setStatus(MIGRATE_TASK_ERR)
 			return err
 		}
 		task.Percent = (slotId - task.FromSlot + 1) * 100 / (task.ToSlot - task.FromSlot + 1)
+		task.setStatus(MIGRATE_TASK_MIGRATING)
+		migrateTaskPercent.Set(float64(task.Percent))
 		log.Info("total percent:", task.Percent)
 	}
-	task.Status = MIGRATE_TASK_FINISHED
+	task.setStatus(MIGRATE_TASK_FINISHED)
 	log.Info("migration finished")
 	return nil
 }
 
+// migrateSlot marks the slot as migrating, moves its data from group from
+// to group to and brings it back online on group to.
+func migrateSlot(s *models.Slot, from, to int, delay int, stopChan <-chan struct{}) error {
+	// modify slot status
+	if err := store.SetMigrateStatus(s, from, to); err != nil {
+		log.Error(err)
+		migrateErrorsTotal.WithLabelValues("set_migrate_status").Inc()
+		return err
+	}
+
+	// do real migrate
+	err := MigrateSingleSlot(s.Id, from, to, delay, stopChan)
+	if err != nil {
+		log.Error(err)
+		if errors.Cause(err) != ErrStopMigrateByUser {
+			migrateErrorsTotal.WithLabelValues("migrate").Inc()
+		}
+		return err
+	}
+
+	// migrate done, change slot status back
+	if err := setSlotOnline(s, to); err != nil {
+		log.Error(err)
+		migrateErrorsTotal.WithLabelValues("set_online").Inc()
+		return err
+	}
+	migrateSlotsTotal.Inc()
+	return nil
+}
+
+// setSlotOnline serves the slot from groupId and clears its migrate status.
+func setSlotOnline(s *models.Slot, groupId int) error {
+	return setSlotOnlineIn(store, s, groupId)
+}
+
+func setSlotOnlineIn(st *models.Store, s *models.Slot, groupId int) error {
+	s.GroupId = groupId
+	s.State.Status = models.SLOT_STATUS_ONLINE
+	s.State.MigrateStatus.From = models.INVALID_ID
+	s.State.MigrateStatus.To = models.INVALID_ID
+	return st.UpdateSlot(s)
+}
+
 func preMigrateCheck(t *MigrateTask) (bool, error) {
 	slots, err := store.GetMigratingSlots()
 	if err != nil {
 		return false, err
 	}
 	// check if there is migrating slot
-	if len(slots) == 0 {
-		return true, nil
-	} else if len(slots) > 1 {
+	if len(slots) > 1 {
 		return false, errors.New("more than one slots are migrating, unknown error")
 	} else if len(slots) == 1 {
 		slot := slots[0]
-		if t.NewGroupId != slot.State.MigrateStatus.To || t.FromSlot != slot.Id || t.ToSlot != slot.Id {
-			return false, errors.Errorf("there is a migrating slot %+v, finish it first", slot)
+		// a paused or interrupted task continues its own slot
+		if t.NewGroupId != slot.State.MigrateStatus.To || slot.Id < t.FromSlot || slot.Id > t.ToSlot {
+			return false, errors.Errorf("there is a migrating slot %+v, finish it first or run `slot repair`", slot)
 		}
 	}
+	if err := checkMigrateSafety(t, localCluster()); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
@@ -0,0 +1,261 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const defaultRebalanceTolerance = 0.1
+
+type rebalanceGroup struct {
+	GroupId int
+	Weight  float64
+	Before  int64
+	Bytes   int64
+	Target  int64
+	Slots   []*SlotStats
+}
+
+type rebalanceMove struct {
+	SlotId int
+	From   int
+	To     int
+	Bytes  int64
+}
+
+func newSlotRebalanceCmd() *cli.Command {
+	return &cli.Command{
+		Name:        "rebalance",
+		Description: "plan slot migrations so that data volume per group is balanced, run the plan with `slot migrate --plan`",
+		Flags: []cli.Flag{
+			&cli.Float64Flag{
+				Name:  "tolerance",
+				Usage: "allowed deviation of each group from its target volume, as a fraction",
+				Value: defaultRebalanceTolerance,
+			},
+			&cli.StringSliceFlag{
+				Name:  "weight",
+				Usage: "relative capacity of a group as <group_id>=<weight>, 1 by default",
+			},
+			&cli.Int64Flag{
+				Name:  "elem-size",
+				Usage: "approximate bytes per element of HASH/LIST/SET/ZSET keys",
+				Value: defaultElemSize,
+			},
+			&cli.IntFlag{
+				Name:  "delay",
+				Usage: "delay time in ms written to every plan entry",
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "write the plan to a file instead of stdout",
+			},
+		},
+		Action: runSlotRebalance,
+	}
+}
+
+func parseGroupWeights(values []string) (map[int]float64, error) {
+	weights := make(map[int]float64, len(values))
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid weight %q, should be <group_id>=<weight>", v)
+		}
+		gid, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, errors.Errorf("invalid weight %q, should be <group_id>=<weight>", v)
+		}
+		w, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || w <= 0 {
+			return nil, errors.Errorf("invalid weight %q, should be a positive number", v)
+		}
+		weights[gid] = w
+	}
+	return weights, nil
+}
+
+// planRebalance moves slots from the most loaded group to the least loaded
+// one until every group is within tolerance of its target. Each step moves
+// the biggest slot not larger than the gap, so few bytes are moved overall.
+func planRebalance(r *StatsReport, weights map[int]float64, tolerance float64) ([]rebalanceMove, []*rebalanceGroup, error) {
+	groups := make(map[int]*rebalanceGroup, len(r.Groups))
+	var list []*rebalanceGroup
+	var sumWeight float64
+	for _, g := range r.Groups {
+		w, ok := weights[g.GroupId]
+		if !ok {
+			w = 1
+		}
+		rg := &rebalanceGroup{GroupId: g.GroupId, Weight: w}
+		groups[g.GroupId] = rg
+		list = append(list, rg)
+		sumWeight += w
+	}
+	for gid := range weights {
+		if _, ok := groups[gid]; !ok {
+			return nil, nil, errors.NotFoundf("group %d", gid)
+		}
+	}
+	if len(list) < 2 {
+		return nil, nil, errors.New("need at least two groups to rebalance")
+	}
+
+	var total int64
+	for _, s := range r.Slots {
+		switch s.Status {
+		case models.SLOT_STATUS_ONLINE:
+		case models.SLOT_STATUS_MIGRATE, models.SLOT_STATUS_PRE_MIGRATE:
+			return nil, nil, errors.Errorf("slot %d is migrating, finish it first or run `slot repair`", s.SlotId)
+		default:
+			continue
+		}
+		g, ok := groups[s.GroupId]
+		if !ok {
+			continue
+		}
+		g.Slots = append(g.Slots, s)
+		g.Bytes += s.TotalBytes()
+		total += s.TotalBytes()
+	}
+	for _, g := range list {
+		g.Before = g.Bytes
+		g.Target = int64(float64(total) * g.Weight / sumWeight)
+	}
+
+	var moves []rebalanceMove
+	for len(moves) < len(r.Slots) {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Bytes-list[i].Target > list[j].Bytes-list[j].Target
+		})
+		over, under := list[0], list[len(list)-1]
+		excess, deficit := over.Bytes-over.Target, under.Target-under.Bytes
+		if float64(excess) <= tolerance*float64(over.Target) && float64(deficit) <= tolerance*float64(under.Target) {
+			break
+		}
+		limit := excess
+		if deficit < limit {
+			limit = deficit
+		}
+		idx := pickRebalanceSlot(over.Slots, limit)
+		if idx < 0 {
+			break
+		}
+
+		s := over.Slots[idx]
+		over.Slots = append(over.Slots[:idx], over.Slots[idx+1:]...)
+		under.Slots = append(under.Slots, s)
+		over.Bytes -= s.TotalBytes()
+		under.Bytes += s.TotalBytes()
+		moves = append(moves, rebalanceMove{SlotId: s.SlotId, From: over.GroupId, To: under.GroupId, Bytes: s.TotalBytes()})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].GroupId < list[j].GroupId
+	})
+	return moves, list, nil
+}
+
+// pickRebalanceSlot returns the biggest non-empty slot not larger than limit,
+// or else the smallest slot whose move still narrows the gap, or -1.
+func pickRebalanceSlot(slots []*SlotStats, limit int64) int {
+	best, smallest := -1, -1
+	for i, s := range slots {
+		size := s.TotalBytes()
+		if size == 0 {
+			continue
+		}
+		if size <= limit && (best < 0 || size > slots[best].TotalBytes()) {
+			best = i
+		}
+		if smallest < 0 || size < slots[smallest].TotalBytes() {
+			smallest = i
+		}
+	}
+	if best >= 0 {
+		return best
+	}
+	if smallest >= 0 && slots[smallest].TotalBytes() < 2*limit {
+		return smallest
+	}
+	return -1
+}
+
+// movesToPlan merges moves of consecutive slots to the same group.
+func movesToPlan(moves []rebalanceMove, delay int) []MigrateTaskForm {
+	sorted := append([]rebalanceMove(nil), moves...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].To != sorted[j].To {
+			return sorted[i].To < sorted[j].To
+		}
+		return sorted[i].SlotId < sorted[j].SlotId
+	})
+	plan := make([]MigrateTaskForm, 0, len(sorted))
+	for _, m := range sorted {
+		if n := len(plan); n > 0 && plan[n-1].NewGroupId == m.To && plan[n-1].ToSlot == m.SlotId-1 {
+			plan[n-1].ToSlot = m.SlotId
+			continue
+		}
+		plan = append(plan, MigrateTaskForm{
+			FromSlot:   m.SlotId,
+			ToSlot:     m.SlotId,
+			NewGroupId: m.To,
+			Delay:      delay,
+		})
+	}
+	return plan
+}
+
+func printRebalanceSummary(groups []*rebalanceGroup, moves []rebalanceMove) {
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tWEIGHT\tBEFORE\tAFTER\tTARGET\tSLOTS")
+	for _, g := range groups {
+		fmt.Fprintf(w, "%d\t%g\t%d\t%d\t%d\t%d\n", g.GroupId, g.Weight, g.Before, g.Bytes, g.Target, len(g.Slots))
+	}
+	var moved int64
+	for _, m := range moves {
+		moved += m.Bytes
+	}
+	fmt.Fprintf(w, "\nmove %d slots, about %d bytes\n", len(moves), moved)
+	w.Flush()
+}
+
+func runSlotRebalance(context *cli.Context) error {
+	weights, err := parseGroupWeights(context.StringSlice("weight"))
+	if err != nil {
+		return err
+	}
+	tolerance := context.Float64("tolerance")
+	if tolerance < 0 {
+		return errors.Errorf("invalid tolerance %v", tolerance)
+	}
+	r, err := collectStats(statsOptions{elemSize: context.Int64("elem-size"), topN: defaultTopN})
+	if err != nil {
+		return err
+	}
+	moves, groups, err := planRebalance(r, weights, tolerance)
+	if err != nil {
+		return err
+	}
+	printRebalanceSummary(groups, moves)
+
+	b := encodeMigratePlan(movesToPlan(moves, context.Int("delay")))
+	if file := context.String("output"); file != "" {
+		return errors.Trace(ioutil.WriteFile(file, b, 0644))
+	}
+	fmt.Print(string(b))
+	return nil
+}
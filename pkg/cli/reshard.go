@@ -0,0 +1,301 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+// A reshard first adds the slots, then, once the proxies and data nodes
+// run with the new slot_num, migrates the new slots to spread the keys.
+const (
+	RESHARD_RUNNING   string = "resharding"
+	RESHARD_ADDED     string = "added"
+	RESHARD_MIGRATING string = "migrating"
+	RESHARD_FINISHED  string = "finished"
+)
+
+// ReshardForm records a change of the slot count, so that an interrupted
+// reshard continues with the same layout.
+type ReshardForm struct {
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+	Status   string `json:"status"`
+	CreateAt int64  `json:"create_at"`
+}
+
+func reshardPath() string {
+	return path.Join(models.ProductDir(productName), "reshard")
+}
+
+func loadReshard() (*ReshardForm, error) {
+	b, err := store.Client().Read(reshardPath(), false)
+	if err != nil || b == nil {
+		return nil, errors.Trace(err)
+	}
+	r := &ReshardForm{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, errors.Annotatef(err, "decode %s", reshardPath())
+	}
+	return r, nil
+}
+
+func saveReshard(r *ReshardForm) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(store.Client().Update(reshardPath(), b))
+}
+
+// loadSlotContext is loadContext for the commands mapping keys to slots,
+// they refuse to run when slot_num does not match the stored slots since
+// every key would map to a wrong slot.
+func loadSlotContext(c *cli.Context) error {
+	if err := loadContext(c); err != nil {
+		return err
+	}
+	return checkSlotNum()
+}
+
+// requireSlotNum checks slot_num in the Before of every subcommand but the
+// exempt ones, which work while slot_num and the stored slots differ.
+func requireSlotNum(cmds []*cli.Command, exempt ...string) []*cli.Command {
+	skip := make(map[string]bool, len(exempt))
+	for _, name := range exempt {
+		skip[name] = true
+	}
+	for _, c := range cmds {
+		if !skip[c.Name] {
+			c.Before = func(*cli.Context) error { return checkSlotNum() }
+		}
+	}
+	return cmds
+}
+
+func checkSlotNum() error {
+	n, err := countStoredSlots(store)
+	if err != nil {
+		return err
+	}
+	if n == 0 || n == slotNum {
+		return nil
+	}
+	hint := fmt.Sprintf("set slot_num=%d in the config", n)
+	if slotNum > n {
+		hint += fmt.Sprintf(" or grow the product with `slot reshard --to %d`", slotNum)
+	}
+	if r, err := loadReshard(); err == nil && r != nil && r.Status != RESHARD_FINISHED {
+		hint = fmt.Sprintf("a reshard from %d to %d slots is unfinished, set slot_num=%d and run `slot reshard --to %d` again", r.From, r.To, r.To, r.To)
+	}
+	return errors.Errorf("slot_num is %d but product %s has %d slots, %s", slotNum, productName, n, hint)
+}
+
+func newSlotReshardCmd() *cli.Command {
+	return &cli.Command{
+		Name:        "reshard",
+		Description: "reshard --to <n>, grow the product to n slots, a multiple of the current count: add the slots, then, run again after the proxies and data nodes restart with slot_num=n, migrate the new slots to balance the groups",
+		Flags: append([]cli.Flag{
+			&cli.IntFlag{
+				Name:     "to",
+				Usage:    "new slot count, a multiple of the current one",
+				Required: true,
+			},
+			&cli.Float64Flag{
+				Name:  "tolerance",
+				Usage: "allowed deviation of each group from its share of the data after the migration, as a fraction",
+				Value: defaultRebalanceTolerance,
+			},
+			&cli.IntFlag{
+				Name:  "delay",
+				Usage: "delay time in ms for migrations",
+			},
+			yesFlag,
+		}, append(migrateFlags, migrateCheckFlags...)...),
+		Action: withAudit(allSlotsSnapshot, runSlotReshard),
+	}
+}
+
+// planReshard returns the group of every new slot. With to a multiple of
+// from, a key of new slot j was in old slot j % from since
+// crc % to % from == crc % from, so new slot j starts on the group of old
+// slot j % from and no key changes group when the slots are added. Old
+// proxies and data nodes keep routing correctly until they are restarted
+// with the new slot_num.
+func planReshard(slots []*models.Slot, from, to int) (map[int]int, error) {
+	if to <= from {
+		return nil, errors.Errorf("only growing is supported, the product has %d slots", from)
+	}
+	if to%from != 0 {
+		return nil, errors.Errorf("%d is not a multiple of %d, other slot counts would move every key to another slot at once", to, from)
+	}
+	groups := make(map[int]int, to-from)
+	for _, s := range slots {
+		if s.State.Status != models.SLOT_STATUS_ONLINE || s.GroupId == models.INVALID_ID {
+			return nil, errors.Errorf("slot %d is %s on group %d, every slot must be online before a reshard, see `slot repair`",
+				s.Id, s.State.Status, s.GroupId)
+		}
+	}
+	for j := from; j < to; j++ {
+		groups[j] = slots[j%from].GroupId
+	}
+	return groups, nil
+}
+
+func runSlotReshard(context *cli.Context) error {
+	if err := setMigrateOptions(context); err != nil {
+		return err
+	}
+	if err := setMigrateChecks(context); err != nil {
+		return err
+	}
+	to := context.Int("to")
+	n, err := countStoredSlots(store)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("slots are not initialized, run `slot init`")
+	}
+	r, err := loadReshard()
+	if err != nil {
+		return err
+	}
+	if r != nil && r.Status != RESHARD_FINISHED && r.To != to {
+		return errors.Errorf("a reshard from %d to %d slots is unfinished, finish it first with `slot reshard --to %d`", r.From, r.To, r.To)
+	}
+
+	switch {
+	case r != nil && (r.Status == RESHARD_ADDED || r.Status == RESHARD_MIGRATING):
+		if slotNum != to {
+			return errors.Errorf("slots [%d, %d] are added, set slot_num=%d in the config of this cli, the proxies and the data nodes, restart them and run `slot reshard --to %d` again",
+				r.From, r.To-1, to, to)
+		}
+		return migrateReshard(context, r)
+	case r != nil && r.Status == RESHARD_RUNNING:
+		log.Infof("continue reshard from %d to %d slots", r.From, to)
+		return addReshardSlots(context, r)
+	case n == to:
+		fmt.Printf("product %s already has %d slots\n", productName, to)
+		return nil
+	}
+	return addReshardSlots(context, &ReshardForm{From: n, To: to, Status: RESHARD_RUNNING})
+}
+
+// addReshardSlots creates the new slots on the groups of the old ones, an
+// interrupted run has created part of them.
+func addReshardSlots(context *cli.Context, r *ReshardForm) error {
+	from, to := r.From, r.To
+	slots, err := loadSlots(0, from-1)
+	if err != nil {
+		return err
+	}
+	if len(slots) != from {
+		return errors.Errorf("product %s has %d of slots [0, %d]", productName, len(slots), from-1)
+	}
+	groups, err := planReshard(slots, from, to)
+	if err != nil {
+		return err
+	}
+	impact := []string{
+		fmt.Sprintf("add slots [%d, %d] to product %s, new slot j served by the group of slot j %% %d, no key moves yet", from, to-1, productName, from),
+		fmt.Sprintf("afterwards set slot_num=%d in the config of this cli, the proxies and the data nodes, restart them and run `slot reshard --to %d` again to migrate the new slots", to, to),
+	}
+	if err := confirm(context, impact); err != nil {
+		return err
+	}
+
+	stopChan := make(chan struct{})
+	unlock, err := lockProduct(func() { close(stopChan) })
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if r.CreateAt == 0 {
+		r.CreateAt = time.Now().Unix()
+		if err := saveReshard(r); err != nil {
+			return err
+		}
+	}
+	for j := from; j < to; j++ {
+		select {
+		case <-stopChan:
+			return ErrProductLockLost
+		default:
+		}
+		s := models.NewSlot(productName, j)
+		s.GroupId = groups[j]
+		s.State.Status = models.SLOT_STATUS_ONLINE
+		// running proxies only know the old slots, they load the new ones
+		// when restarted with the new slot_num
+		if err := store.UpdateSlotWithoutAction(s); err != nil {
+			return errors.Annotatef(err, "create slot %d", j)
+		}
+	}
+	r.Status = RESHARD_ADDED
+	if err := saveReshard(r); err != nil {
+		return err
+	}
+	fmt.Printf("product %s has %d slots now: %s\n", productName, to, countSlotsByGroup(append(slots, newSlotsOf(groups)...)))
+	fmt.Printf("set slot_num=%d in the config of this cli, the proxies and the data nodes, restart them and run `slot reshard --to %d` again\n", to, to)
+	return nil
+}
+
+// migrateReshard spreads the slots over the groups by data volume with
+// migrate tasks, running it again after an interruption plans the rest.
+func migrateReshard(context *cli.Context, r *ReshardForm) error {
+	stats, err := collectStats(statsOptions{elemSize: defaultElemSize, topN: defaultTopN})
+	if err != nil {
+		return err
+	}
+	var plan []MigrateTaskForm
+	if len(stats.Groups) > 1 {
+		moves, groups, err := planRebalance(stats, nil, context.Float64("tolerance"))
+		if err != nil {
+			return err
+		}
+		printRebalanceSummary(groups, moves)
+		plan = movesToPlan(moves, context.Int("delay"))
+	}
+	impact := []string{
+		fmt.Sprintf("the proxies and the data nodes must run with slot_num=%d, a data node still on %d slots finds no keys in the new slots and they would be lost", r.To, r.From),
+		fmt.Sprintf("run %d migrate tasks to spread the %d slots of product %s over its groups", len(plan), r.To, productName),
+	}
+	if err := confirm(context, impact); err != nil {
+		return err
+	}
+
+	r.Status = RESHARD_MIGRATING
+	if err := saveReshard(r); err != nil {
+		return err
+	}
+	// every task takes the product lock itself
+	if err := runMigratePlanEntries(plan, context.Int("delay"), PLAN_ON_ERROR_STOP, ""); err != nil {
+		return errors.Annotatef(err, "reshard migration, run `slot reshard --to %d` again to continue", r.To)
+	}
+	r.Status = RESHARD_FINISHED
+	if err := saveReshard(r); err != nil {
+		return err
+	}
+	fmt.Printf("product %s is resharded to %d slots\n", productName, r.To)
+	return nil
+}
+
+func newSlotsOf(groups map[int]int) []*models.Slot {
+	slots := make([]*models.Slot, 0, len(groups))
+	for id, g := range groups {
+		slots = append(slots, &models.Slot{Id: id, GroupId: g})
+	}
+	return slots
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/urfave/cli/v2"
+)
+
+func onlineSlots(groups ...int) []*models.Slot {
+	slots := make([]*models.Slot, len(groups))
+	for i, g := range groups {
+		slots[i] = models.NewSlot("test", i)
+		slots[i].GroupId = g
+		slots[i].State.Status = models.SLOT_STATUS_ONLINE
+	}
+	return slots
+}
+
+func TestPlanReshard(t *testing.T) {
+	tests := []struct {
+		name  string
+		slots []*models.Slot
+		to    int
+		want  map[int]int
+		bad   bool
+	}{
+		{"double", onlineSlots(1, 2, 1, 3), 8, map[int]int{4: 1, 5: 2, 6: 1, 7: 3}, false},
+		{"triple", onlineSlots(1, 2), 6, map[int]int{2: 1, 3: 2, 4: 1, 5: 2}, false},
+		{"not a multiple", onlineSlots(1, 2, 1, 3), 6, nil, true},
+		{"not a multiple, above double", onlineSlots(1, 2, 1, 3), 10, nil, true},
+		{"same count", onlineSlots(1, 2), 2, nil, true},
+		{"shrink", onlineSlots(1, 2, 1, 3), 2, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := planReshard(tt.slots, len(tt.slots), tt.to)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("%s: planned %v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+		for j, g := range tt.want {
+			if got[j] != g {
+				t.Errorf("%s: slot %d on group %d, want group %d of slot %d", tt.name, j, got[j], g, j%len(tt.slots))
+			}
+		}
+	}
+
+	slots := onlineSlots(1, 2)
+	slots[1].State.Status = models.SLOT_STATUS_MIGRATE
+	if _, err := planReshard(slots, 2, 4); err == nil {
+		t.Errorf("reshard planned with a migrating slot")
+	}
+}
+
+func TestRequireSlotNum(t *testing.T) {
+	for _, c := range NewSlotCmd().Subcommands {
+		exempt := c.Name == "init" || c.Name == "reshard"
+		if exempt != (c.Before == nil) {
+			t.Errorf("slot %s checks slot_num %v, want %v", c.Name, c.Before != nil, !exempt)
+		}
+	}
+}
+
+func TestRunSlotReshardStages(t *testing.T) {
+	useMemStore(t, 2)
+	setTestSlot(t, 0, 1, models.INVALID_ID)
+	setTestSlot(t, 1, 2, models.INVALID_ID)
+	app := &cli.App{Commands: []*cli.Command{newSlotReshardCmd()}}
+	run := func() error {
+		return app.Run([]string{"cli", "reshard", "--to", "4", "--yes"})
+	}
+
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := loadReshard()
+	if err != nil || r == nil || r.Status != RESHARD_ADDED {
+		t.Fatalf("reshard %+v, %v, want status %s", r, err, RESHARD_ADDED)
+	}
+	for j, g := range []int{1, 2, 1, 2} {
+		s, err := store.GetSlot(j, true)
+		if err != nil || s.GroupId != g {
+			t.Fatalf("slot %d: %+v, %v, want group %d", j, s, err, g)
+		}
+	}
+
+	// the keys are not migrated before this cli runs with the new slot_num
+	if err := run(); err == nil || !strings.Contains(err.Error(), "set slot_num=4") {
+		t.Errorf("second run before the restart: %v", err)
+	}
+	if err := app.Run([]string{"cli", "reshard", "--to", "8", "--yes"}); err == nil || !strings.Contains(err.Error(), "unfinished") {
+		t.Errorf("another reshard while one is unfinished: %v", err)
+	}
+}
@@ -14,7 +14,7 @@ import (
 
 	"github.com/IceFireDB/kit/pkg/models"
 
-	log "github.com/IceFireDB/kit/pkg/logger"
+	log "github.com/IceFireDB/cli/pkg/log"
 )
 
 // codis redis instance manage tool
@@ -31,25 +31,22 @@ func NewGroupCmd() *cli.Command {
 			{
 				Name:        "add",
 				Description: "add <group_id> <redis_addr>",
-				Action:      runAddServerToGroup,
+				Action:      withAudit(groupSnapshot, runAddServerToGroup),
 			},
 			{
 				Name:        "remove",
 				Description: "remove <group_id> <redis_addr>",
-				Action:      runRemoveServerFromGroup,
+				Action:      withAudit(groupSnapshot, runRemoveServerFromGroup),
 			},
 			{
 				Name:        "remove-group",
 				Description: "remove-group <group_id>",
-				Action:      runRemoveServerGroup,
+				Flags:       []cli.Flag{yesFlag},
+				Action:      withAudit(groupSnapshot, runRemoveServerGroup),
 			},
+			newServerWatchCmd(),
 		},
-		Before: func(c *cli.Context) error {
-			store = c.Context.Value("store").(*models.Store)
-			productName = c.Context.Value("product").(string)
-			slotNum = c.Context.Value("slotNum").(int)
-			return nil
-		},
+		Before: loadContext,
 	}
 	return c
 }
@@ -59,7 +56,10 @@ func runAddServerToGroup(context *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	addr := context.Args().Get(1)
+	return addServerToGroup(groupId, context.Args().Get(1))
+}
+
+func addServerToGroup(groupId int, addr string) error {
 	serverGroup, err := store.LoadGroup(groupId, false)
 	if err != nil {
 		return err
@@ -111,7 +111,17 @@ func runRemoveServerGroup(context *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	slots, err := store.Slots()
+	if err != nil {
+		return err
+	}
+	if err := confirm(context, removeGroupImpact(sg, slots)); err != nil {
+		return err
+	}
+	return removeServerGroup(sg)
+}
 
+func removeServerGroup(sg *models.ServerGroup) error {
 	if len(sg.Servers) != 0 {
 		for _, server := range sg.Servers {
 			err := store.DeleteServer(server.Addr)
@@ -122,7 +132,7 @@ func runRemoveServerGroup(context *cli.Context) error {
 			}
 		}
 	}
-	err = store.DeleteGroup(groupId)
+	err := store.DeleteGroup(sg.Id)
 	if err != nil {
 		return err
 	}
@@ -135,7 +145,19 @@ func runRemoveServerFromGroup(context *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	addr := context.Args().Get(1)
+	return removeServerFromGroup(groupId, context.Args().Get(1))
+}
+
+func removeServerFromGroup(groupId int, addr string) error {
+	if err := detachServerFromGroup(groupId, addr); err != nil {
+		return err
+	}
+	return store.DeleteServer(addr)
+}
+
+// detachServerFromGroup drops the server from the group but keeps its
+// record, which another group may point to.
+func detachServerFromGroup(groupId int, addr string) error {
 	serverGroup, err := store.LoadGroup(groupId, true)
 	if err != nil {
 		log.Warn(err)
@@ -152,12 +174,5 @@ func runRemoveServerFromGroup(context *cli.Context) error {
 		servers = append(servers, s)
 	}
 	serverGroup.Servers = servers
-	if err := store.UpdateGroup(serverGroup); err != nil {
-		return err
-	}
-	err = store.DeleteServer(addr)
-	if err != nil {
-		return err
-	}
-	return nil
+	return store.UpdateGroup(serverGroup)
 }
@@ -0,0 +1,311 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+const defaultSessionTTL = 30 * time.Second
+
+const (
+	SESSION_ALIVE   string = "alive"
+	SESSION_ORPHAN  string = "orphan"
+	SESSION_UNKNOWN string = "unknown"
+)
+
+// Session is the registration of a running cli under the living-cli dir.
+// It extends models.Lock, registrations of older clis only have the host
+// and pid. A session whose heartbeat is older than its ttl is an orphan.
+type Session struct {
+	Name      string `json:"-"`
+	Hostname  string `json:"hostname"`
+	Pid       int    `json:"pid"`
+	StartAt   int64  `json:"start_at,omitempty"`
+	Command   string `json:"command,omitempty"`
+	Heartbeat int64  `json:"heartbeat,omitempty"`
+	TTL       int64  `json:"ttl,omitempty"`
+}
+
+// SessionInfo is a session with its computed state, as listed.
+type SessionInfo struct {
+	Name string `json:"name"`
+	*Session
+	State  string `json:"state"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func newSession(command string, ttl time.Duration) *Session {
+	l := models.NewLock()
+	now := time.Now().Unix()
+	return &Session{
+		Name:      l.Name(),
+		Hostname:  l.Hostname,
+		Pid:       l.Pid,
+		StartAt:   now,
+		Command:   command,
+		Heartbeat: now,
+		TTL:       int64(ttl / time.Second),
+	}
+}
+
+// redactArgs hides the value of password flags in the recorded command.
+func redactArgs(args []string) string {
+	out := make([]string, len(args))
+	hide := false
+	for i, a := range args {
+		switch {
+		case hide:
+			out[i], hide = "***", false
+		case strings.HasPrefix(a, "-") && strings.Contains(a, "password"):
+			if idx := strings.Index(a, "="); idx >= 0 {
+				out[i] = a[:idx+1] + "***"
+			} else {
+				out[i], hide = a, true
+			}
+		default:
+			out[i] = a
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// processExists tells whether pid runs on this host, pids of other hosts
+// mean nothing here.
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// onThisHost tells whether the session was registered on this host, only
+// then its pid can be checked.
+func (s *Session) onThisHost() bool {
+	host, err := os.Hostname()
+	return err == nil && host != "" && host == s.Hostname
+}
+
+func (s *Session) state(now time.Time) (string, string) {
+	if s.onThisHost() && !processExists(s.Pid) {
+		return SESSION_ORPHAN, "process exited"
+	}
+	if s.Heartbeat == 0 {
+		return SESSION_UNKNOWN, "no heartbeat, registered by an older cli"
+	}
+	if age := now.Unix() - s.Heartbeat; s.TTL > 0 && age > s.TTL {
+		return SESSION_ORPHAN, fmt.Sprintf("no heartbeat for %ds", age)
+	}
+	return SESSION_ALIVE, ""
+}
+
+func saveSession(st *models.Store, s *Session) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(st.Client().Update(st.CliPath(s.Name), b))
+}
+
+func loadSession(st *models.Store, name string) (*Session, error) {
+	b, err := st.Client().Read(st.CliPath(name), false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if b == nil {
+		return nil, errors.NotFoundf("session %s", name)
+	}
+	s := &Session{Name: name}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, errors.Annotatef(err, "session %s", name)
+	}
+	return s, nil
+}
+
+func listSessions(st *models.Store) ([]*SessionInfo, error) {
+	paths, err := st.Client().List(st.CliDir(), false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	now := time.Now()
+	var sessions []*SessionInfo
+	for _, p := range paths {
+		s, err := loadSession(st, path.Base(p))
+		if errors.IsNotFound(err) {
+			// removed meanwhile
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		state, reason := s.state(now)
+		sessions = append(sessions, &SessionInfo{Name: s.Name, Session: s, State: state, Reason: reason})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartAt < sessions[j].StartAt
+	})
+	return sessions, nil
+}
+
+// removeOrphanSessions deletes the registrations of clis that are gone.
+func removeOrphanSessions(st *models.Store) error {
+	sessions, err := listSessions(st)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if s.State != SESSION_ORPHAN {
+			continue
+		}
+		log.Infof("remove orphan session %s: %s", s.Name, s.Reason)
+		if err := st.Client().Delete(st.CliPath(s.Name)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// RegisterSession registers the running cli in st, removes orphaned
+// sessions and keeps the heartbeat of the new session until the returned
+// func is called, which has to happen before the session is unregistered.
+func RegisterSession(st *models.Store, args []string) (string, func(), error) {
+	sess := newSession(redactArgs(args), defaultSessionTTL)
+	if err := saveSession(st, sess); err != nil {
+		return "", nil, err
+	}
+	if err := removeOrphanSessions(st); err != nil {
+		log.Warnf("remove orphan sessions failed: %v", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(defaultSessionTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			sess.Heartbeat = time.Now().Unix()
+			if err := saveSession(st, sess); err != nil {
+				log.Warnf("session %s heartbeat failed: %v", sess.Name, err)
+			}
+		}
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+	return sess.Name, stop, nil
+}
+
+func NewSessionCmd() *cli.Command {
+	return &cli.Command{
+		Name: "session",
+		Subcommands: []*cli.Command{
+			{
+				Name:        "list",
+				Description: "list the registered clis with their host, pid, start time and command",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "output format (text, json)",
+						Value: "text",
+					},
+				},
+				Action: runSessionList,
+			},
+			{
+				Name:        "remove",
+				Description: "remove <name>, remove the registration of a cli that is gone",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "remove the session even though it is alive",
+					},
+				},
+				Action: runSessionRemove,
+			},
+		},
+		Before: loadContext,
+	}
+}
+
+func formatUnix(ts int64) string {
+	if ts == 0 {
+		return "-"
+	}
+	return time.Unix(ts, 0).Format(time.RFC3339)
+}
+
+func runSessionList(context *cli.Context) error {
+	sessions, err := listSessions(store)
+	if err != nil {
+		return err
+	}
+	switch format := context.String("format"); format {
+	case "json":
+		b, _ := json.MarshalIndent(sessions, " ", "  ")
+		fmt.Println(string(b))
+		return nil
+	case "text":
+	default:
+		return errors.Errorf("invalid format %q, should be one of (text, json)", format)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tHOST\tPID\tSTARTED\tHEARTBEAT\tSTATE\tCOMMAND")
+	for _, s := range sessions {
+		state := s.State
+		if s.Name == livingNode {
+			state += " (this cli)"
+		} else if s.Reason != "" {
+			state += " (" + s.Reason + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", s.Name, s.Hostname, s.Pid,
+			formatUnix(s.StartAt), formatUnix(s.Heartbeat), state, s.Command)
+	}
+	return errors.Trace(w.Flush())
+}
+
+func runSessionRemove(context *cli.Context) error {
+	name := context.Args().Get(0)
+	if name == "" {
+		return errors.New("session name is required, see `session list`")
+	}
+	if name == livingNode {
+		return errors.New("cannot remove the session of this cli")
+	}
+	s, err := loadSession(store, name)
+	if err != nil {
+		return err
+	}
+	if st, _ := s.state(time.Now()); st == SESSION_ALIVE && !context.Bool("force") {
+		return errors.Errorf("session %s is alive (heartbeat %s), use --force to remove it anyway", name, formatUnix(s.Heartbeat))
+	}
+	return errors.Trace(store.Client().Delete(store.CliPath(name)))
+}
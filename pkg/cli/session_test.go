@@ -0,0 +1,53 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSessionState(t *testing.T) {
+	host, _ := os.Hostname()
+	now := time.Unix(1000, 0)
+	// a pid no process uses
+	deadPid := 1 << 22
+	tests := []struct {
+		name string
+		s    Session
+		want string
+	}{
+		{"alive", Session{Hostname: host, Pid: os.Getpid(), Heartbeat: 990, TTL: 30}, SESSION_ALIVE},
+		{"process exited", Session{Hostname: host, Pid: deadPid, Heartbeat: 990, TTL: 30}, SESSION_ORPHAN},
+		{"other host, pid not checked", Session{Hostname: host + "-other", Pid: deadPid, Heartbeat: 990, TTL: 30}, SESSION_ALIVE},
+		{"other host, heartbeat expired", Session{Hostname: host + "-other", Pid: deadPid, Heartbeat: 900, TTL: 30}, SESSION_ORPHAN},
+		{"older cli", Session{Hostname: host + "-other", Pid: deadPid}, SESSION_UNKNOWN},
+	}
+	for _, tt := range tests {
+		if got, reason := tt.s.state(now); got != tt.want {
+			t.Errorf("%s: state %s (%s), want %s", tt.name, got, reason, tt.want)
+		}
+	}
+}
+
+func TestRegisterSessionStop(t *testing.T) {
+	c := useMemStore(t, 4)
+	name, stop, err := RegisterSession(store, []string{"slot", "migrate", "--coordinator-password", "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadSession(store, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Command != "slot migrate --coordinator-password ***" {
+		t.Errorf("command %q", s.Command)
+	}
+	stop()
+	stop()
+	if err := c.Delete(store.CliPath(name)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -14,7 +14,7 @@ import (
 	"github.com/IceFireDB/kit/pkg/models"
 	"github.com/juju/errors"
 
-	log "github.com/IceFireDB/kit/pkg/logger"
+	log "github.com/IceFireDB/cli/pkg/log"
 	uuid "github.com/nu7hatch/gouuid"
 )
 
@@ -22,12 +22,28 @@ var (
 	store       *models.Store
 	productName string
 	slotNum     int
+	livingNode  string
 )
 
+// loadContext picks up the global objects set up by main.
+func loadContext(c *cli.Context) error {
+	store = c.Context.Value("store").(*models.Store)
+	productName = c.Context.Value("product").(string)
+	slotNum = c.Context.Value("slotNum").(int)
+	livingNode, _ = c.Context.Value("livingNode").(string)
+	lockClient, _ = c.Context.Value("lockClient").(LockClient)
+	openCluster, _ = c.Context.Value("openCluster").(ClusterOpener)
+	dataNode, _ = c.Context.Value("dataNode").(*DataNodeConfig)
+	if dataNode != nil {
+		return dataNode.init()
+	}
+	return nil
+}
+
 func NewSlotCmd() *cli.Command {
 	c := &cli.Command{
 		Name: "slot",
-		Subcommands: []*cli.Command{
+		Subcommands: requireSlotNum([]*cli.Command{
 			{
 				Name:        "init",
 				Description: "init slot",
@@ -38,8 +54,9 @@ func NewSlotCmd() *cli.Command {
 						Usage:   "force set slot to initial state regardless of existence",
 						Value:   false,
 					},
+					yesFlag,
 				},
-				Action: runSlotInit,
+				Action: withAudit(allSlotsSnapshot, runSlotInit),
 			},
 			{
 				Name:        "info",
@@ -49,31 +66,81 @@ func NewSlotCmd() *cli.Command {
 			{
 				Name:        "set",
 				Description: "set <slot_id> <group_id> <status>",
-				Action:      runSlotSet,
+				Action:      withAudit(singleSlotSnapshot, runSlotSet),
 			},
 			{
 				Name:        "range-set",
 				Description: "range-set <slot_from> <slot_to> <group_id> <status>",
-				Action:      runSlotRangeSet,
+				Flags:       []cli.Flag{yesFlag},
+				Action:      withAudit(slotRangeSnapshot, runSlotRangeSet),
 			},
 			{
 				Name:        "migrate",
-				Description: "migrate <slot_from> <slot_to> <group_id>",
-				Flags: []cli.Flag{
+				Description: "migrate <slot_from> <slot_to> <group_id> | migrate --rollback <task_id> | migrate --plan <file> | migrate --resume <task_id> | migrate --to-product <name> --to-group <id> <slot_from> <slot_to>",
+				Flags: append([]cli.Flag{
 					&cli.IntFlag{
 						Name:  "delay",
 						Usage: "delay time in ms",
 					},
-				},
-				Action: runSlotMigrate,
+					&cli.StringFlag{
+						Name:  "rollback",
+						Usage: "move the slots of a migrate task back to their source groups",
+					},
+					&cli.StringFlag{
+						Name:  "plan",
+						Usage: "run the migrations listed in a plan file, as written by `slot rebalance`",
+					},
+					&cli.StringFlag{
+						Name:  "on-error",
+						Usage: "what a plan does when an entry fails (stop, continue), it always stops when a slot is left in migrate status",
+						Value: PLAN_ON_ERROR_STOP,
+					},
+					&cli.StringFlag{
+						Name:  "report",
+						Usage: "write the status of every plan entry to this file after each entry, it can be run again as a plan",
+					},
+					&cli.StringFlag{
+						Name:  "at",
+						Usage: "start the migration at this local time, e.g. 01:30 or \"2006-01-02 01:30\"",
+					},
+					&cli.StringFlag{
+						Name:  "window",
+						Usage: "only migrate within this daily window, e.g. 01:00-05:00, pause in between, a slot still migrating when it closes is finished first",
+					},
+					&cli.StringFlag{
+						Name:  "resume",
+						Usage: "continue a scheduled, paused or interrupted migrate task",
+					},
+					&cli.StringFlag{
+						Name:  "to-product",
+						Usage: "migrate the slots to a group of another product, each slot is offline, neither read nor written, while its keys are copied",
+					},
+					&cli.IntFlag{
+						Name:  "to-group",
+						Usage: "group of --to-product receiving the slots",
+					},
+					&cli.StringFlag{
+						Name:  "to-config",
+						Usage: "config file of --to-product when it uses another coordinator or data node credentials",
+					},
+					yesFlag,
+				}, append(migrateFlags, migrateCheckFlags...)...),
+				Action: withAudit(migrateSnapshot, runSlotMigrate),
 			},
-		},
-		Before: func(c *cli.Context) error {
-			store = c.Context.Value("store").(*models.Store)
-			productName = c.Context.Value("product").(string)
-			slotNum = c.Context.Value("slotNum").(int)
-			return nil
-		},
+			{
+				Name:        "tasks",
+				Description: "list migrate tasks",
+				Action:      runSlotTasks,
+			},
+			newSlotRepairCmd(),
+			newSlotStatsCmd(),
+			newSlotRebalanceCmd(),
+			newSlotWatchCmd(),
+			newSlotDumpCmd(),
+			newSlotRestoreCmd(),
+			newSlotReshardCmd(),
+		}, "init", "reshard"),
+		Before: loadContext,
 	}
 	return c
 }
@@ -88,6 +155,16 @@ func runSlotInit(context *cli.Context) error {
 		if s != nil {
 			return errors.New("slots already exists. use -f flag to force init")
 		}
+	} else {
+		slots, err := loadSlots(0, slotNum-1)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(slots) > 0 {
+			if err := confirm(context, slotInitImpact(slots)); err != nil {
+				return err
+			}
+		}
 	}
 	err := store.InitSlotSet(productName, slotNum)
 	if err != nil {
@@ -101,6 +178,9 @@ func runSlotInfo(context *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	if err := checkSlotId(slotId); err != nil {
+		return err
+	}
 	s, err := store.GetSlot(slotId, true)
 	if err != nil {
 		return errors.Trace(err)
@@ -123,8 +203,14 @@ func runSlotRangeSet(context *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("parse groupId err %w", err)
 	}
-	status := context.Args().Get(3)
-	err = store.SetSlotRange(productName, fromSlotId, toSlotId, groupId, models.SlotStatus(status))
+	slots, status, err := checkSlotSet(fromSlotId, toSlotId, groupId, context.Args().Get(3))
+	if err != nil {
+		return err
+	}
+	if err := confirm(context, slotRangeSetImpact(slots, fromSlotId, toSlotId, groupId, status)); err != nil {
+		return err
+	}
+	err = store.SetSlotRange(productName, fromSlotId, toSlotId, groupId, status)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -140,8 +226,11 @@ func runSlotSet(context *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("parse groupId err %w", err)
 	}
-	status := context.Args().Get(2)
-	err = store.SetSlotRange(productName, slotId, slotId, groupId, models.SlotStatus(status))
+	_, status, err := checkSlotSet(slotId, slotId, groupId, context.Args().Get(2))
+	if err != nil {
+		return err
+	}
+	err = store.SetSlotRange(productName, slotId, slotId, groupId, status)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -149,6 +238,32 @@ func runSlotSet(context *cli.Context) error {
 }
 
 func runSlotMigrate(context *cli.Context) error {
+	if err := setMigrateOptions(context); err != nil {
+		return err
+	}
+	if err := setMigrateChecks(context); err != nil {
+		return err
+	}
+	if (context.IsSet("at") || context.IsSet("window")) && (context.IsSet("rollback") || context.IsSet("plan") || context.IsSet("resume") || context.IsSet("to-product")) {
+		return errors.New("--at and --window only apply to a new migrate task within the product")
+	}
+	if context.IsSet("to-product") {
+		return runCrossMigrate(context)
+	}
+	if id := context.String("rollback"); id != "" {
+		t, err := loadMigrateTask(id)
+		if err != nil {
+			return err
+		}
+		return errors.Trace(RunRollbackTask(t, context.Int("delay")))
+	}
+	if file := context.String("plan"); file != "" {
+		return runMigratePlan(file, context.Int("delay"), context.String("on-error"), context.String("report"))
+	}
+	if id := context.String("resume"); id != "" {
+		return resumeMigrateTask(id)
+	}
+
 	fromSlotId, err := strconv.Atoi(context.Args().Get(0))
 	if err != nil {
 		return fmt.Errorf("parse fromSlotId err %w", err)
@@ -161,7 +276,55 @@ func runSlotMigrate(context *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("parse groupId err %w", err)
 	}
-	delay := context.Int("delay")
+	if err := checkSlotRange(fromSlotId, toSlotId); err != nil {
+		return err
+	}
+	if err := checkGroupExists(newGroupId); err != nil {
+		return err
+	}
+	t, err := newMigrateTask(fromSlotId, toSlotId, newGroupId, context.Int("delay"))
+	if err != nil {
+		return err
+	}
+	if at := context.String("at"); at != "" {
+		start, err := parseMigrateAt(at, time.Now())
+		if err != nil {
+			return err
+		}
+		t.StartAt = start.Unix()
+	}
+	if w := context.String("window"); w != "" {
+		if _, err := parseMigrateWindow(w); err != nil {
+			return err
+		}
+		t.Window = w
+	}
+	if t.StartAt == 0 && t.Window == "" {
+		return runMigrate(t)
+	}
+	log.Infof("migrate task %s scheduled: %s, resume it with `slot migrate --resume %s` after a restart",
+		t.Id, t.describeSchedule(), t.Id)
+	return runScheduledMigrate(t)
+}
+
+func resumeMigrateTask(id string) error {
+	t, err := loadMigrateTask(id)
+	if err != nil {
+		return err
+	}
+	if t.ToProduct != "" {
+		return errors.Errorf("migrate task %s moves slots to product %s, run the same `slot migrate --to-product` again to continue it", id, t.ToProduct)
+	}
+	switch t.Status {
+	case MIGRATE_TASK_SCHEDULED, MIGRATE_TASK_PAUSED, MIGRATE_TASK_MIGRATING, MIGRATE_TASK_ERR:
+	default:
+		return errors.Errorf("migrate task %s is %s, cannot resume it", id, t.Status)
+	}
+	t.stopChan = make(chan struct{})
+	return runScheduledMigrate(t)
+}
+
+func newMigrateTask(fromSlotId, toSlotId, newGroupId, delay int) (*MigrateTask, error) {
 	t := &MigrateTask{}
 	t.Delay = delay
 	t.FromSlot = fromSlotId
@@ -172,10 +335,15 @@ func runSlotMigrate(context *cli.Context) error {
 	u, err := uuid.NewV4()
 	if err != nil {
 		log.Warn(err)
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 	t.Id = u.String()
 	t.stopChan = make(chan struct{})
+	return t, nil
+}
+
+func runMigrate(t *MigrateTask) error {
+	log.Infof("migrate task %s: slots [%d, %d] to group %d", t.Id, t.FromSlot, t.ToSlot, t.NewGroupId)
 
 	// run migrate
 	if ok, err := preMigrateCheck(t); ok {
@@ -190,3 +358,38 @@ func runSlotMigrate(context *cli.Context) error {
 	}
 	return nil
 }
+
+func migrateSnapshot(c *cli.Context) (interface{}, error) {
+	if id := c.String("rollback"); id != "" {
+		t, err := loadMigrateTask(id)
+		if err != nil {
+			return nil, err
+		}
+		return loadSlots(t.FromSlot, t.ToSlot)
+	}
+	if c.String("plan") != "" {
+		return allSlotsSnapshot(c)
+	}
+	if id := c.String("resume"); id != "" {
+		t, err := loadMigrateTask(id)
+		if err != nil {
+			return nil, err
+		}
+		return loadSlots(t.FromSlot, t.ToSlot)
+	}
+	return slotRangeSnapshot(c)
+}
+
+func runSlotTasks(context *cli.Context) error {
+	tasks, err := listMigrateTasks()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	forms := make([]MigrateTaskForm, 0, len(tasks))
+	for _, t := range tasks {
+		forms = append(forms, t.MigrateTaskForm)
+	}
+	b, _ := json.MarshalIndent(forms, " ", "  ")
+	fmt.Println(string(b))
+	return nil
+}
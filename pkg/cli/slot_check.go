@@ -0,0 +1,91 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"strings"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/juju/errors"
+)
+
+// statuses an operator may set by hand, migrate and pre_migrate are only
+// set by `slot migrate`.
+var settableSlotStatus = []models.SlotStatus{
+	models.SLOT_STATUS_ONLINE,
+	models.SLOT_STATUS_OFFLINE,
+}
+
+func parseSlotStatus(status string) (models.SlotStatus, error) {
+	for _, s := range settableSlotStatus {
+		if models.SlotStatus(strings.ToLower(status)) == s {
+			return s, nil
+		}
+	}
+	valid := make([]string, 0, len(settableSlotStatus))
+	for _, s := range settableSlotStatus {
+		valid = append(valid, string(s))
+	}
+	return "", errors.Errorf("invalid slot status %q, valid statuses are (%s)", status, strings.Join(valid, ", "))
+}
+
+func checkSlotId(slotId int) error {
+	if slotId < 0 || slotId >= slotNum {
+		return errors.Errorf("slot id %d out of range [0, %d)", slotId, slotNum)
+	}
+	return nil
+}
+
+func checkSlotRange(from, to int) error {
+	if err := checkSlotId(from); err != nil {
+		return err
+	}
+	if err := checkSlotId(to); err != nil {
+		return err
+	}
+	if from > to {
+		return errors.Errorf("invalid slot range [%d, %d], from should be <= to", from, to)
+	}
+	return nil
+}
+
+func checkGroupExists(groupId int) error {
+	exists, err := store.GroupExists(groupId)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !exists {
+		return errors.NotFoundf("group %d", groupId)
+	}
+	return nil
+}
+
+// checkSlotSet validates a `slot set` / `slot range-set` request and returns
+// the current state of the slots it touches.
+func checkSlotSet(from, to, groupId int, status string) ([]*models.Slot, models.SlotStatus, error) {
+	st, err := parseSlotStatus(status)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkSlotRange(from, to); err != nil {
+		return nil, "", err
+	}
+	if err := checkGroupExists(groupId); err != nil {
+		return nil, "", err
+	}
+	slots, err := loadSlots(from, to)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	for _, s := range slots {
+		if s.State.Status != models.SLOT_STATUS_MIGRATE {
+			continue
+		}
+		if st == models.SLOT_STATUS_ONLINE && groupId != s.State.MigrateStatus.To {
+			return nil, "", errors.Errorf("slot %d is migrating from group %d to group %d, cannot set it online on group %d",
+				s.Id, s.State.MigrateStatus.From, s.State.MigrateStatus.To, groupId)
+		}
+	}
+	return slots, st, nil
+}
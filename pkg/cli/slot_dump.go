@@ -0,0 +1,432 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/IceFireDB/kit/pkg/router"
+	"github.com/garyburd/redigo/redis"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+// version 1 stored the ttl left at dump time, version 2 the expiry time
+const slotDumpVersion = 2
+
+// A slot dump is a file of json lines: the header, one line per key and
+// the footer, which tells that the file is complete. Values are in the
+// format of the dump commands of the data node.
+type SlotDumpHeader struct {
+	Version  int    `json:"version"`
+	Product  string `json:"product"`
+	SlotId   int    `json:"slot"`
+	SlotNum  int    `json:"slot_num"`
+	GroupId  int    `json:"group_id"`
+	Addr     string `json:"addr"`
+	CreateAt int64  `json:"create_at"`
+}
+
+type SlotDumpKey struct {
+	Type string `json:"type"`
+	Key  []byte `json:"key"`
+	// unix time the key expires, 0 means no expiration
+	ExpireAt int64 `json:"expire_at,omitempty"`
+	// seconds left at dump time, only in version 1 dumps
+	TTL   int64  `json:"ttl,omitempty"`
+	Value []byte `json:"value"`
+}
+
+// ttl returns the seconds left at now, 0 for a key without expiration.
+// An expired key is not restored.
+func (e *SlotDumpKey) ttl(now time.Time) (int64, bool) {
+	if e.ExpireAt == 0 {
+		return 0, false
+	}
+	left := e.ExpireAt - now.Unix()
+	return left, left <= 0
+}
+
+type SlotDumpFooter struct {
+	Keys map[string]int64 `json:"keys"`
+}
+
+type slotDumpLine struct {
+	Header *SlotDumpHeader `json:"header,omitempty"`
+	Key    *SlotDumpKey    `json:"key,omitempty"`
+	Footer *SlotDumpFooter `json:"footer,omitempty"`
+}
+
+func newSlotDumpCmd() *cli.Command {
+	return &cli.Command{
+		Name:        "dump",
+		Description: "dump <slot_id> -o <file>, save every key of a slot with its ttl from the owning master",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "output",
+				Aliases:  []string{"o"},
+				Usage:    "dump file",
+				Required: true,
+			},
+		},
+		Action: runSlotDump,
+	}
+}
+
+func newSlotRestoreCmd() *cli.Command {
+	return &cli.Command{
+		Name:        "restore",
+		Description: "restore <slot_id> -i <file>, write the keys of a slot dump back to the owning master",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "input",
+				Aliases:  []string{"i"},
+				Usage:    "dump file",
+				Required: true,
+			},
+			&cli.IntFlag{
+				Name:  "group",
+				Usage: "restore to the master of this group instead of the group owning the slot",
+			},
+			&cli.BoolFlag{
+				Name:  "replace",
+				Usage: "replace keys that exist, they are skipped by default",
+			},
+			yesFlag,
+		},
+		Action: withAudit(singleSlotSnapshot, runSlotRestore),
+	}
+}
+
+func parseSlotIdArg(context *cli.Context) (int, error) {
+	slotId, err := strconv.Atoi(context.Args().Get(0))
+	if err != nil {
+		return 0, fmt.Errorf("parse slotId err %w", err)
+	}
+	return slotId, checkSlotId(slotId)
+}
+
+func formatKeyCounts(cnt map[string]int64) string {
+	parts := make([]string, 0, len(dataTypes))
+	for _, tp := range dataTypes {
+		parts = append(parts, fmt.Sprintf("%s %d", tp, cnt[tp]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// dumpKeys reads the ttl and value of keys, pipelined, and keeps when they
+// expire. Keys removed since they were scanned are left out.
+func dumpKeys(c redis.Conn, dataType string, keys [][]byte) ([]*SlotDumpKey, error) {
+	cmds := typeCmds[dataType]
+	for _, key := range keys {
+		if err := c.Send(cmds.ttl, key); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err := c.Send(cmds.dump, key); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	now := time.Now().Unix()
+	entries := make([]*SlotDumpKey, 0, len(keys))
+	for _, key := range keys {
+		ttl, err := redis.Int64(c.Receive())
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s %s", cmds.ttl, key)
+		}
+		value, err := redis.Bytes(c.Receive())
+		if err == redis.ErrNil {
+			continue
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "%s %s", cmds.dump, key)
+		}
+		e := &SlotDumpKey{Type: dataType, Key: key, Value: value}
+		if ttl > 0 {
+			e.ExpireAt = now + ttl
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func dumpSlot(w io.Writer, s *models.Slot, addr string) (map[string]int64, error) {
+	c, err := dialServer(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	enc := json.NewEncoder(w)
+	header := &SlotDumpHeader{
+		Version:  slotDumpVersion,
+		Product:  productName,
+		SlotId:   s.Id,
+		SlotNum:  slotNum,
+		GroupId:  s.GroupId,
+		Addr:     addr,
+		CreateAt: time.Now().Unix(),
+	}
+	if err := enc.Encode(&slotDumpLine{Header: header}); err != nil {
+		return nil, errors.Trace(err)
+	}
+	cnt := make(map[string]int64, len(dataTypes))
+	for _, tp := range dataTypes {
+		err := scanKeyBatches(c, tp, func(keys [][]byte) error {
+			var slotKeys [][]byte
+			for _, key := range keys {
+				if router.MapKey2Slot(key, slotNum) == s.Id {
+					slotKeys = append(slotKeys, key)
+				}
+			}
+			if len(slotKeys) == 0 {
+				return nil
+			}
+			entries, err := dumpKeys(c, tp, slotKeys)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if err := enc.Encode(&slotDumpLine{Key: e}); err != nil {
+					return errors.Trace(err)
+				}
+			}
+			cnt[tp] += int64(len(entries))
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Annotatef(err, "dump %s keys", tp)
+		}
+	}
+	if err := enc.Encode(&slotDumpLine{Footer: &SlotDumpFooter{Keys: cnt}}); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return cnt, nil
+}
+
+func runSlotDump(context *cli.Context) error {
+	slotId, err := parseSlotIdArg(context)
+	if err != nil {
+		return err
+	}
+	s, err := store.GetSlot(slotId, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if s.State.Status == models.SLOT_STATUS_MIGRATE {
+		return errors.Errorf("slot %d is migrating from group %d to group %d, its keys are on both groups, finish the migration first",
+			slotId, s.State.MigrateStatus.From, s.State.MigrateStatus.To)
+	}
+	if s.GroupId == models.INVALID_ID {
+		return errors.Errorf("slot %d is not assigned to any group", slotId)
+	}
+	m, err := loadGroupMaster(s.GroupId)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file so that a failed dump leaves no partial file
+	file := context.String("output")
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.Remove(tmp)
+	w := bufio.NewWriter(f)
+	cnt, err := dumpSlot(w, s, m.Addr)
+	if err == nil {
+		err = w.Flush()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return errors.Annotatef(err, "dump slot %d from %s", slotId, m.Addr)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Printf("dumped %d keys of slot %d from group %d (%s) to %s: %s\n",
+		sumKeys(cnt), slotId, s.GroupId, m.Addr, file, formatKeyCounts(cnt))
+	return nil
+}
+
+// readSlotDump walks the keys of a dump file, it fails on a truncated file
+// only after the last key, so check a file with a nil fn first.
+func readSlotDump(file string, fn func(e *SlotDumpKey) error) (*SlotDumpHeader, *SlotDumpFooter, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var header *SlotDumpHeader
+	for n := 1; ; n++ {
+		var line slotDumpLine
+		if err := dec.Decode(&line); err == io.EOF {
+			return nil, nil, errors.Errorf("%s is truncated, no footer", file)
+		} else if err != nil {
+			return nil, nil, errors.Annotatef(err, "%s line %d", file, n)
+		}
+		switch {
+		case header == nil:
+			if line.Header == nil {
+				return nil, nil, errors.Errorf("%s is not a slot dump, no header", file)
+			}
+			if line.Header.Version < 1 || line.Header.Version > slotDumpVersion {
+				return nil, nil, errors.Errorf("%s has unsupported version %d", file, line.Header.Version)
+			}
+			header = line.Header
+		case line.Key != nil:
+			if _, ok := typeCmds[line.Key.Type]; !ok {
+				return nil, nil, errors.Errorf("%s line %d: unknown data type %q", file, n, line.Key.Type)
+			}
+			if header.Version == 1 && line.Key.TTL > 0 {
+				line.Key.ExpireAt, line.Key.TTL = header.CreateAt+line.Key.TTL, 0
+			}
+			if fn != nil {
+				if err := fn(line.Key); err != nil {
+					return nil, nil, err
+				}
+			}
+		case line.Footer != nil:
+			return header, line.Footer, nil
+		default:
+			return nil, nil, errors.Errorf("%s line %d: unexpected line", file, n)
+		}
+	}
+}
+
+// restoreKey writes a key back with ttl seconds left. It returns false for
+// an existing key that is not replaced.
+func restoreKey(c redis.Conn, e *SlotDumpKey, ttl int64, replace bool) (bool, error) {
+	cmds := typeCmds[e.Type]
+	n, err := redis.Int(c.Do(cmds.exists, e.Key))
+	if err != nil {
+		return false, errors.Annotatef(err, "%s %s", cmds.exists, e.Key)
+	}
+	if n != 0 {
+		if !replace {
+			return false, nil
+		}
+		if _, err := c.Do(cmds.clear, e.Key); err != nil {
+			return false, errors.Annotatef(err, "%s %s", cmds.clear, e.Key)
+		}
+	}
+	if _, err := c.Do("restore", e.Key, ttl, e.Value); err != nil {
+		return false, errors.Annotatef(err, "restore %s %s", e.Type, e.Key)
+	}
+	return true, nil
+}
+
+func runSlotRestore(context *cli.Context) error {
+	slotId, err := parseSlotIdArg(context)
+	if err != nil {
+		return err
+	}
+	file := context.String("input")
+	header, footer, err := readSlotDump(file, nil)
+	if err != nil {
+		return err
+	}
+	if header.SlotNum != slotNum {
+		return errors.Errorf("%s was dumped with %d slots, the product has %d, keys would map to other slots",
+			file, header.SlotNum, slotNum)
+	}
+	if header.SlotId != slotId {
+		return errors.Errorf("%s is a dump of slot %d, not slot %d", file, header.SlotId, slotId)
+	}
+	if header.Product != productName {
+		log.Warnf("%s is a dump of product %s, restoring to product %s", file, header.Product, productName)
+	}
+
+	groupId := context.Int("group")
+	if !context.IsSet("group") {
+		s, err := store.GetSlot(slotId, true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if s.State.Status == models.SLOT_STATUS_MIGRATE {
+			return errors.Errorf("slot %d is migrating, pass --group to choose where to restore", slotId)
+		}
+		groupId = s.GroupId
+	}
+	if err := checkGroupExists(groupId); err != nil {
+		return err
+	}
+	m, err := loadGroupMaster(groupId)
+	if err != nil {
+		return err
+	}
+
+	existing := "existing keys are skipped"
+	if context.Bool("replace") {
+		existing = "existing keys are replaced"
+	}
+	impact := []string{
+		fmt.Sprintf("restore %d keys of slot %d (%s) dumped from group %d (%s) at %s",
+			sumKeys(footer.Keys), slotId, formatKeyCounts(footer.Keys), header.GroupId, header.Addr, formatUnix(header.CreateAt)),
+		fmt.Sprintf("write them to group %d master %s, %s, keys expired since the dump are skipped", groupId, m.Addr, existing),
+	}
+	if err := confirm(context, impact); err != nil {
+		return err
+	}
+
+	c, err := dialServer(m.Addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	restored := make(map[string]int64, len(dataTypes))
+	skipped := make(map[string]int64, len(dataTypes))
+	expired := make(map[string]int64, len(dataTypes))
+	_, _, err = readSlotDump(file, func(e *SlotDumpKey) error {
+		if router.MapKey2Slot(e.Key, slotNum) != slotId {
+			return errors.Errorf("key %q of the dump belongs to slot %d", e.Key, router.MapKey2Slot(e.Key, slotNum))
+		}
+		ttl, gone := e.ttl(time.Now())
+		if gone {
+			expired[e.Type]++
+			return nil
+		}
+		ok, err := restoreKey(c, e, ttl, context.Bool("replace"))
+		if err != nil {
+			return err
+		}
+		if ok {
+			restored[e.Type]++
+		} else {
+			skipped[e.Type]++
+		}
+		if n := sumKeys(restored) + sumKeys(skipped) + sumKeys(expired); n%10000 == 0 {
+			log.Infof("restored %d of %d keys", n, sumKeys(footer.Keys))
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Annotatef(err, "restore slot %d to %s, %d keys restored", slotId, m.Addr, sumKeys(restored))
+	}
+	fmt.Printf("restored %d keys of slot %d to group %d (%s): %s\n",
+		sumKeys(restored), slotId, groupId, m.Addr, formatKeyCounts(restored))
+	if n := sumKeys(skipped); n > 0 {
+		fmt.Printf("skipped %d existing keys: %s, use --replace to overwrite them\n", n, formatKeyCounts(skipped))
+	}
+	if n := sumKeys(expired); n > 0 {
+		fmt.Printf("skipped %d keys expired since the dump: %s\n", n, formatKeyCounts(expired))
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSlotDumpKeyTTL(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		expireAt int64
+		ttl      int64
+		expired  bool
+	}{
+		{0, 0, false},
+		{1060, 60, false},
+		{1000, 0, true},
+		{900, -100, true},
+	}
+	for _, tt := range tests {
+		e := &SlotDumpKey{ExpireAt: tt.expireAt}
+		if ttl, expired := e.ttl(now); ttl != tt.ttl || expired != tt.expired {
+			t.Errorf("expire at %d: ttl %d expired %v, want %d %v", tt.expireAt, ttl, expired, tt.ttl, tt.expired)
+		}
+	}
+}
+
+func TestReadSlotDumpVersions(t *testing.T) {
+	tests := []struct {
+		version int
+		key     string
+		want    int64
+	}{
+		// version 1 keeps the ttl left at dump time
+		{1, `{"type":"KV","key":"YQ==","ttl":60,"value":""}`, 1060},
+		{1, `{"type":"KV","key":"YQ==","value":""}`, 0},
+		{2, `{"type":"KV","key":"YQ==","expire_at":1090,"value":""}`, 1090},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "dump")
+		data := fmt.Sprintf("{\"header\":{\"version\":%d,\"slot\":1,\"slot_num\":4,\"create_at\":1000}}\n{\"key\":%s}\n{\"footer\":{\"keys\":{\"KV\":1}}}\n",
+			tt.version, tt.key)
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var got []*SlotDumpKey
+		_, _, err := readSlotDump(file, func(e *SlotDumpKey) error {
+			got = append(got, e)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("version %d: %v", tt.version, err)
+		}
+		if len(got) != 1 || got[0].ExpireAt != tt.want {
+			t.Errorf("version %d %s: keys %+v, want expire at %d", tt.version, tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+const (
+	REPAIR_ACTION_FINISH     string = "finish"
+	REPAIR_ACTION_ROLLBACK   string = "rollback"
+	REPAIR_ACTION_ONLINE_SRC string = "online-from"
+	REPAIR_ACTION_ONLINE_DST string = "online-to"
+	REPAIR_ACTION_SKIP       string = "skip"
+)
+
+var repairActions = []string{
+	REPAIR_ACTION_FINISH,
+	REPAIR_ACTION_ROLLBACK,
+	REPAIR_ACTION_ONLINE_SRC,
+	REPAIR_ACTION_ONLINE_DST,
+	REPAIR_ACTION_SKIP,
+}
+
+// slotRepairReport shows where the data of a stuck migrating slot lives.
+type slotRepairReport struct {
+	Slot       int              `json:"slot"`
+	From       int              `json:"from"`
+	To         int              `json:"to"`
+	FromMaster string           `json:"from_master,omitempty"`
+	ToMaster   string           `json:"to_master,omitempty"`
+	FromKeys   map[string]int64 `json:"from_keys,omitempty"`
+	ToKeys     map[string]int64 `json:"to_keys,omitempty"`
+	FromErr    string           `json:"from_err,omitempty"`
+	ToErr      string           `json:"to_err,omitempty"`
+}
+
+func newSlotRepairCmd() *cli.Command {
+	return &cli.Command{
+		Name:        "repair",
+		Description: "repair [slot_id], recover slots left in migrate status by a crashed migration",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "action",
+				Usage: "one of (" + strings.Join(repairActions, ", ") + "), asked interactively when empty",
+			},
+			&cli.IntFlag{
+				Name:  "delay",
+				Usage: "delay time in ms when finishing or rolling back",
+			},
+			yesFlag,
+		}, migrateFlags...),
+		Action: withAudit(repairSnapshot, runSlotRepair),
+	}
+}
+
+func repairSnapshot(c *cli.Context) (interface{}, error) {
+	if c.NArg() > 0 {
+		return singleSlotSnapshot(c)
+	}
+	return allSlotsSnapshot(c)
+}
+
+func inspectMigratingSlot(s *models.Slot) *slotRepairReport {
+	r := &slotRepairReport{
+		Slot: s.Id,
+		From: s.State.MigrateStatus.From,
+		To:   s.State.MigrateStatus.To,
+	}
+	r.FromMaster, r.FromKeys, r.FromErr = inspectSlotOnGroup(s.Id, r.From)
+	r.ToMaster, r.ToKeys, r.ToErr = inspectSlotOnGroup(s.Id, r.To)
+	return r
+}
+
+func inspectSlotOnGroup(slotId, groupId int) (string, map[string]int64, string) {
+	m, err := loadGroupMaster(groupId)
+	if err != nil {
+		return "", nil, err.Error()
+	}
+	c, err := dialServer(m.Addr)
+	if err != nil {
+		return m.Addr, nil, err.Error()
+	}
+	defer c.Close()
+	cnt, err := countSlotKeys(c, []int{slotId})
+	if err != nil {
+		return m.Addr, nil, err.Error()
+	}
+	return m.Addr, cnt[slotId], ""
+}
+
+func askRepairAction(r *slotRepairReport) (string, error) {
+	if !stdinIsTerminal() {
+		return "", errors.New("--action is required when stdin is not a terminal")
+	}
+	fmt.Fprintf(os.Stderr, "repair slot %d [%s]: ", r.Slot, strings.Join(repairActions, "/"))
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", ErrAbortedByUser
+	}
+	return strings.TrimSpace(answer), nil
+}
+
+func repairImpact(r *slotRepairReport, action string) []string {
+	switch action {
+	case REPAIR_ACTION_FINISH:
+		return []string{fmt.Sprintf("migrate the remaining %d keys of slot %d from group %d to group %d, then serve it from group %d",
+			sumKeys(r.FromKeys), r.Slot, r.From, r.To, r.To)}
+	case REPAIR_ACTION_ROLLBACK:
+		return []string{fmt.Sprintf("migrate the %d keys of slot %d back from group %d to group %d, then serve it from group %d",
+			sumKeys(r.ToKeys), r.Slot, r.To, r.From, r.From)}
+	case REPAIR_ACTION_ONLINE_SRC:
+		return []string{fmt.Sprintf("serve slot %d from group %d without moving data, %d keys on group %d become unreachable",
+			r.Slot, r.From, sumKeys(r.ToKeys), r.To)}
+	case REPAIR_ACTION_ONLINE_DST:
+		return []string{fmt.Sprintf("serve slot %d from group %d without moving data, %d keys on group %d become unreachable",
+			r.Slot, r.To, sumKeys(r.FromKeys), r.From)}
+	}
+	return nil
+}
+
+func repairSlot(s *models.Slot, r *slotRepairReport, action string, delay int, stopChan <-chan struct{}) error {
+	switch action {
+	case REPAIR_ACTION_FINISH:
+		if r.FromErr != "" || r.ToErr != "" {
+			return errors.Errorf("cannot finish slot %d, masters are not reachable", r.Slot)
+		}
+		return migrateSlot(s, r.From, r.To, delay, stopChan)
+	case REPAIR_ACTION_ROLLBACK:
+		if r.FromErr != "" || r.ToErr != "" {
+			return errors.Errorf("cannot roll back slot %d, masters are not reachable", r.Slot)
+		}
+		return migrateSlot(s, r.To, r.From, delay, stopChan)
+	case REPAIR_ACTION_ONLINE_SRC:
+		return setSlotOnline(s, r.From)
+	case REPAIR_ACTION_ONLINE_DST:
+		return setSlotOnline(s, r.To)
+	}
+	return nil
+}
+
+func runSlotRepair(context *cli.Context) error {
+	if err := setMigrateOptions(context); err != nil {
+		return err
+	}
+	action := context.String("action")
+	if action != "" && !isRepairAction(action) {
+		return errors.Errorf("invalid action %q, should be one of (%s)", action, strings.Join(repairActions, ", "))
+	}
+
+	slots, err := store.GetMigratingSlots()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if context.NArg() > 0 {
+		slotId, err := strconv.Atoi(context.Args().Get(0))
+		if err != nil {
+			return fmt.Errorf("parse slotId err %w", err)
+		}
+		var filtered []models.Slot
+		for _, s := range slots {
+			if s.Id == slotId {
+				filtered = append(filtered, s)
+			}
+		}
+		slots = filtered
+	}
+	if len(slots) == 0 {
+		fmt.Println("no migrating slot")
+		return nil
+	}
+
+	// decide every slot before the lock, so that it is not held while
+	// waiting for the operator
+	type repair struct {
+		slot   *models.Slot
+		report *slotRepairReport
+		action string
+	}
+	var repairs []repair
+	for i := range slots {
+		s := &slots[i]
+		r := inspectMigratingSlot(s)
+		b, _ := json.MarshalIndent(r, " ", "  ")
+		fmt.Println(string(b))
+
+		act := action
+		if act == "" {
+			if act, err = askRepairAction(r); err != nil {
+				return err
+			}
+			if !isRepairAction(act) {
+				return errors.Errorf("invalid action %q", act)
+			}
+		}
+		if act == REPAIR_ACTION_SKIP {
+			continue
+		}
+		if err := confirm(context, repairImpact(r, act)); err != nil {
+			return err
+		}
+		repairs = append(repairs, repair{s, r, act})
+	}
+	if len(repairs) == 0 {
+		return nil
+	}
+
+	stopChan := make(chan struct{})
+	unlock, err := lockProduct(func() { close(stopChan) })
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, rp := range repairs {
+		select {
+		case <-stopChan:
+			return ErrProductLockLost
+		default:
+		}
+		// another cli may have repaired the slot before the lock was taken
+		s, err := store.GetSlot(rp.slot.Id, true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if s.State.Status != models.SLOT_STATUS_MIGRATE || s.State.MigrateStatus != rp.slot.State.MigrateStatus {
+			log.Warnf("slot %d changed meanwhile (group %d, status %s), skip it", s.Id, s.GroupId, s.State.Status)
+			continue
+		}
+		log.Infof("repair slot %d: %s", s.Id, rp.action)
+		if err := repairSlot(s, rp.report, rp.action, context.Int("delay"), stopChan); err != nil {
+			if errors.Cause(err) == ErrStopMigrateByUser {
+				return ErrProductLockLost
+			}
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func isRepairAction(action string) bool {
+	for _, a := range repairActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
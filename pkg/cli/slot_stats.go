@@ -0,0 +1,448 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"container/heap"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/IceFireDB/kit/pkg/router"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+const (
+	defaultElemSize = 64
+	defaultBigKey   = 10000
+	defaultTopN     = 10
+)
+
+// SlotStats is the data held by one slot. Bytes are approximate: the value
+// length for KV and the number of elements times the element size otherwise.
+type SlotStats struct {
+	SlotId  int               `json:"slot"`
+	GroupId int               `json:"group_id"`
+	Status  models.SlotStatus `json:"status"`
+	Keys    map[string]int64  `json:"keys"`
+	Bytes   map[string]int64  `json:"bytes"`
+}
+
+func (s *SlotStats) TotalKeys() int64 {
+	return sumKeys(s.Keys)
+}
+
+func (s *SlotStats) TotalBytes() int64 {
+	return sumKeys(s.Bytes)
+}
+
+// GroupStats sums up the slots served by a group. StrayKeys are keys found
+// on the master that belong to a slot the group neither serves nor migrates.
+type GroupStats struct {
+	GroupId   int    `json:"group_id"`
+	Master    string `json:"master"`
+	Slots     int    `json:"slots"`
+	Keys      int64  `json:"keys"`
+	Bytes     int64  `json:"bytes"`
+	StrayKeys int64  `json:"stray_keys,omitempty"`
+}
+
+// BigKey is a key that makes a migratedb batch slow.
+type BigKey struct {
+	Key     string `json:"key"`
+	Type    string `json:"type"`
+	SlotId  int    `json:"slot"`
+	GroupId int    `json:"group_id"`
+	Size    int64  `json:"size"`
+}
+
+type StatsReport struct {
+	Slots    []*SlotStats  `json:"slots"`
+	Groups   []*GroupStats `json:"groups"`
+	Heaviest []*SlotStats  `json:"heaviest"`
+	BigKeys  []*BigKey     `json:"big_keys"`
+	// (max - min) / mean of the bytes per group
+	Skew float64 `json:"skew"`
+}
+
+// SlotSizes keeps the approximate bytes of slots found by `slot stats` and
+// by the capacity check, so that a migration does not scan the keyspace of
+// its source groups again.
+type SlotSizes struct {
+	SlotNum int               `json:"slot_num"`
+	Slots   map[int]*SlotSize `json:"slots"`
+}
+
+type SlotSize struct {
+	Bytes int64 `json:"bytes"`
+	// unix time the size was measured
+	At int64 `json:"at"`
+}
+
+// sizes measured by this cli, kept between the entries of a plan and the
+// windows of a task
+var slotSizeCache *SlotSizes
+
+func slotSizesPath() string {
+	return path.Join(models.ProductDir(productName), "slot_sizes")
+}
+
+// loadSlotSizes returns the sizes measured for the current slot_num.
+func loadSlotSizes() (*SlotSizes, error) {
+	if slotSizeCache != nil && slotSizeCache.SlotNum == slotNum {
+		return slotSizeCache, nil
+	}
+	sizes := &SlotSizes{SlotNum: slotNum, Slots: make(map[int]*SlotSize)}
+	b, err := store.Client().Read(slotSizesPath(), false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if b != nil {
+		saved := &SlotSizes{}
+		if err := json.Unmarshal(b, saved); err != nil {
+			log.Warnf("decode %s failed: %v, ignored", slotSizesPath(), err)
+		} else if saved.SlotNum == slotNum && saved.Slots != nil {
+			sizes = saved
+		}
+	}
+	slotSizeCache = sizes
+	return sizes, nil
+}
+
+// fresh returns the size of slotId measured within maxAge.
+func (s *SlotSizes) fresh(slotId int, now time.Time, maxAge time.Duration) (int64, bool) {
+	sz, ok := s.Slots[slotId]
+	if !ok || now.Sub(time.Unix(sz.At, 0)) > maxAge {
+		return 0, false
+	}
+	return sz.Bytes, true
+}
+
+// saveSlotSizes records bytes per slot measured at now, other slots keep
+// their size.
+func saveSlotSizes(bytes map[int]int64, now time.Time) error {
+	sizes, err := loadSlotSizes()
+	if err != nil {
+		return err
+	}
+	for id, n := range bytes {
+		sizes.Slots[id] = &SlotSize{Bytes: n, At: now.Unix()}
+	}
+	b, err := json.Marshal(sizes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(store.Client().Update(slotSizesPath(), b))
+}
+
+type statsOptions struct {
+	elemSize int64
+	bigKey   int64
+	topN     int
+}
+
+func newSlotStatsCmd() *cli.Command {
+	return &cli.Command{
+		Name:        "stats",
+		Description: "show per-slot key counts and approximate size read from the group masters",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "output format (text, json, csv)",
+				Value: "text",
+			},
+			&cli.Int64Flag{
+				Name:  "elem-size",
+				Usage: "approximate bytes per element of HASH/LIST/SET/ZSET keys",
+				Value: defaultElemSize,
+			},
+			&cli.Int64Flag{
+				Name:  "big-key",
+				Usage: "report keys with more elements (or KV bytes) than this",
+				Value: defaultBigKey,
+			},
+			&cli.IntFlag{
+				Name:  "top",
+				Usage: "number of heaviest slots and big keys to report",
+				Value: defaultTopN,
+			},
+		},
+		Action: runSlotStats,
+	}
+}
+
+func newSlotStats(s *models.Slot) *SlotStats {
+	return &SlotStats{
+		SlotId:  s.Id,
+		GroupId: s.GroupId,
+		Status:  s.State.Status,
+		Keys:    make(map[string]int64, len(dataTypes)),
+		Bytes:   make(map[string]int64, len(dataTypes)),
+	}
+}
+
+// collectStats walks the keyspace of every group master.
+func collectStats(opt statsOptions) (*StatsReport, error) {
+	slots, err := store.Slots()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	groups, err := store.ListGroup()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	r := &StatsReport{}
+	slotStats := make(map[int]*SlotStats, len(slots))
+	slotInfo := make(map[int]models.Slot, len(slots))
+	for i, s := range slots {
+		slotStats[s.Id] = newSlotStats(&slots[i])
+		slotInfo[s.Id] = s
+	}
+
+	gids := make([]int, 0, len(groups))
+	for gid := range groups {
+		gids = append(gids, gid)
+	}
+	sort.Ints(gids)
+	for _, gid := range gids {
+		g := groups[gid]
+		m, err := store.Master(g)
+		if err != nil {
+			return nil, errors.Annotatef(err, "group %d", gid)
+		}
+		gs := &GroupStats{GroupId: gid, Master: m.Addr}
+		r.Groups = append(r.Groups, gs)
+		log.Infof("collecting stats of group %d from %s", gid, m.Addr)
+		if err := collectGroupStats(gs, slotStats, slotInfo, opt, r); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range slots {
+		ss := slotStats[s.Id]
+		r.Slots = append(r.Slots, ss)
+		for _, gs := range r.Groups {
+			if gs.GroupId == ss.GroupId {
+				gs.Slots++
+				gs.Keys += ss.TotalKeys()
+				gs.Bytes += ss.TotalBytes()
+			}
+		}
+	}
+	sort.Slice(r.Slots, func(i, j int) bool {
+		return r.Slots[i].SlotId < r.Slots[j].SlotId
+	})
+
+	r.Heaviest = append(r.Heaviest, r.Slots...)
+	sort.SliceStable(r.Heaviest, func(i, j int) bool {
+		return r.Heaviest[i].TotalBytes() > r.Heaviest[j].TotalBytes()
+	})
+	if len(r.Heaviest) > opt.topN {
+		r.Heaviest = r.Heaviest[:opt.topN]
+	}
+	sort.SliceStable(r.BigKeys, func(i, j int) bool {
+		return r.BigKeys[i].Size > r.BigKeys[j].Size
+	})
+	r.Skew = groupSkew(r.Groups)
+
+	bytes := make(map[int]int64, len(r.Slots))
+	for _, ss := range r.Slots {
+		bytes[ss.SlotId] = ss.TotalBytes()
+	}
+	if err := saveSlotSizes(bytes, time.Now()); err != nil {
+		log.Warnf("save slot sizes failed: %v", err)
+	}
+	return r, nil
+}
+
+func collectGroupStats(gs *GroupStats, slotStats map[int]*SlotStats, slotInfo map[int]models.Slot, opt statsOptions, r *StatsReport) error {
+	c, err := dialServer(gs.Master)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for _, tp := range dataTypes {
+		err := scanKeyBatches(c, tp, func(keys [][]byte) error {
+			sizes, err := keySizes(c, tp, keys)
+			if err != nil {
+				return err
+			}
+			for i, key := range keys {
+				slotId := router.MapKey2Slot(key, slotNum)
+				s, ok := slotInfo[slotId]
+				if !ok || !slotOnGroup(&s, gs.GroupId) {
+					gs.StrayKeys++
+					continue
+				}
+				ss := slotStats[slotId]
+				ss.Keys[tp]++
+				bytes := sizes[i]
+				if tp != "KV" {
+					bytes *= opt.elemSize
+				}
+				ss.Bytes[tp] += int64(len(key)) + bytes
+				if opt.bigKey > 0 && sizes[i] > opt.bigKey {
+					r.BigKeys = addBigKey(r.BigKeys, &BigKey{
+						Key:     string(key),
+						Type:    tp,
+						SlotId:  slotId,
+						GroupId: gs.GroupId,
+						Size:    sizes[i],
+					}, opt.topN)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Annotatef(err, "scan %s on %s", tp, gs.Master)
+		}
+	}
+	return nil
+}
+
+// bigKeyHeap is a min-heap by size, the smallest of the kept keys is
+// dropped first.
+type bigKeyHeap []*BigKey
+
+func (h bigKeyHeap) Len() int            { return len(h) }
+func (h bigKeyHeap) Less(i, j int) bool  { return h[i].Size < h[j].Size }
+func (h bigKeyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *bigKeyHeap) Push(x interface{}) { *h = append(*h, x.(*BigKey)) }
+func (h *bigKeyHeap) Pop() interface{} {
+	old := *h
+	k := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return k
+}
+
+// addBigKey keeps the topN biggest keys in keys, a bigKeyHeap until the
+// report is sorted, so a keyspace full of big keys is never held at once.
+func addBigKey(keys []*BigKey, k *BigKey, topN int) []*BigKey {
+	h := bigKeyHeap(keys)
+	switch {
+	case topN <= 0:
+	case len(h) < topN:
+		heap.Push(&h, k)
+	case k.Size > h[0].Size:
+		h[0] = k
+		heap.Fix(&h, 0)
+	}
+	return h
+}
+
+// slotOnGroup tells whether the group serves the slot or takes part in its
+// migration.
+func slotOnGroup(s *models.Slot, groupId int) bool {
+	if s.State.Status == models.SLOT_STATUS_MIGRATE {
+		return s.State.MigrateStatus.From == groupId || s.State.MigrateStatus.To == groupId
+	}
+	return s.GroupId == groupId
+}
+
+func groupSkew(groups []*GroupStats) float64 {
+	if len(groups) == 0 {
+		return 0
+	}
+	min, max, total := groups[0].Bytes, groups[0].Bytes, int64(0)
+	for _, g := range groups {
+		if g.Bytes < min {
+			min = g.Bytes
+		}
+		if g.Bytes > max {
+			max = g.Bytes
+		}
+		total += g.Bytes
+	}
+	if total == 0 {
+		return 0
+	}
+	mean := float64(total) / float64(len(groups))
+	return float64(max-min) / mean
+}
+
+func runSlotStats(context *cli.Context) error {
+	format := context.String("format")
+	switch format {
+	case "text", "json", "csv":
+	default:
+		return errors.Errorf("invalid format %q, should be one of (text, json, csv)", format)
+	}
+	r, err := collectStats(statsOptions{
+		elemSize: context.Int64("elem-size"),
+		bigKey:   context.Int64("big-key"),
+		topN:     context.Int("top"),
+	})
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "json":
+		b, _ := json.MarshalIndent(r, " ", "  ")
+		fmt.Println(string(b))
+		return nil
+	case "csv":
+		return writeStatsCSV(r)
+	}
+	printStats(r)
+	return nil
+}
+
+func writeStatsCSV(r *StatsReport) error {
+	w := csv.NewWriter(os.Stdout)
+	header := []string{"slot", "group_id"}
+	for _, tp := range dataTypes {
+		header = append(header, tp+"_keys", tp+"_bytes")
+	}
+	header = append(header, "keys", "bytes")
+	if err := w.Write(header); err != nil {
+		return errors.Trace(err)
+	}
+	for _, s := range r.Slots {
+		row := []string{strconv.Itoa(s.SlotId), strconv.Itoa(s.GroupId)}
+		for _, tp := range dataTypes {
+			row = append(row, strconv.FormatInt(s.Keys[tp], 10), strconv.FormatInt(s.Bytes[tp], 10))
+		}
+		row = append(row, strconv.FormatInt(s.TotalKeys(), 10), strconv.FormatInt(s.TotalBytes(), 10))
+		if err := w.Write(row); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	w.Flush()
+	return errors.Trace(w.Error())
+}
+
+func printStats(r *StatsReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tMASTER\tSLOTS\tKEYS\tBYTES\tSTRAY KEYS")
+	for _, g := range r.Groups {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%d\n", g.GroupId, g.Master, g.Slots, g.Keys, g.Bytes, g.StrayKeys)
+	}
+	fmt.Fprintf(w, "\nskew between groups: %.2f\n", r.Skew)
+
+	fmt.Fprintln(w, "\nHEAVIEST SLOT\tGROUP\tKEYS\tBYTES")
+	for _, s := range r.Heaviest {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\n", s.SlotId, s.GroupId, s.TotalKeys(), s.TotalBytes())
+	}
+
+	if len(r.BigKeys) > 0 {
+		fmt.Fprintln(w, "\nBIG KEY\tTYPE\tSLOT\tGROUP\tSIZE")
+		for _, k := range r.BigKeys {
+			fmt.Fprintf(w, "%q\t%s\t%d\t%d\t%d\n", k.Key, k.Type, k.SlotId, k.GroupId, k.Size)
+		}
+	}
+	w.Flush()
+}
@@ -0,0 +1,40 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestAddBigKey(t *testing.T) {
+	sizes := []int64{5, 90, 12, 70, 3, 70, 100, 1, 45}
+	tests := []struct {
+		topN int
+		want []int64
+	}{
+		{3, []int64{100, 90, 70}},
+		{1, []int64{100}},
+		{20, []int64{100, 90, 70, 70, 45, 12, 5, 3, 1}},
+		{0, nil},
+	}
+	for _, tt := range tests {
+		var keys []*BigKey
+		for i, n := range sizes {
+			keys = addBigKey(keys, &BigKey{Key: fmt.Sprintf("k%d", i), Size: n}, tt.topN)
+			if tt.topN > 0 && len(keys) > tt.topN {
+				t.Fatalf("top %d: %d keys kept", tt.topN, len(keys))
+			}
+		}
+		got := make([]int64, 0, len(keys))
+		for _, k := range keys {
+			got = append(got, k.Size)
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i] > got[j] })
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("top %d: %v, want %v", tt.topN, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+// Topology is the desired state of a product read from a topology file.
+type Topology struct {
+	Product string          `yaml:"product" json:"product,omitempty"`
+	Groups  []TopologyGroup `yaml:"groups" json:"groups"`
+}
+
+// TopologyGroup declares a group, its servers and the slots it serves.
+// Slots are written as "from-to" ranges or single slot ids. Master is
+// refused, the type of a server is registered by the data node and the
+// cli cannot promote one.
+type TopologyGroup struct {
+	Id      int      `yaml:"id" json:"id"`
+	Servers []string `yaml:"servers" json:"servers"`
+	Master  string   `yaml:"master,omitempty" json:"master,omitempty"`
+	Slots   []string `yaml:"slots,omitempty" json:"slots,omitempty"`
+}
+
+const (
+	TOPOLOGY_OP_ADD_SERVER    string = "add-server"
+	TOPOLOGY_OP_INIT_SLOTS    string = "init-slots"
+	TOPOLOGY_OP_SET_SLOTS     string = "set-slots"
+	TOPOLOGY_OP_MIGRATE_SLOTS string = "migrate-slots"
+	TOPOLOGY_OP_REMOVE_SERVER string = "remove-server"
+	TOPOLOGY_OP_DETACH_SERVER string = "detach-server"
+	TOPOLOGY_OP_REMOVE_GROUP  string = "remove-group"
+)
+
+// TopologyStep is one change needed to reach the desired topology, steps
+// are listed in the order they are applied.
+type TopologyStep struct {
+	Op      string `json:"op"`
+	GroupId int    `json:"group_id"`
+	Addr    string `json:"addr,omitempty"`
+	From    int    `json:"from,omitempty"`
+	To      int    `json:"to,omitempty"`
+}
+
+func (s TopologyStep) String() string {
+	switch s.Op {
+	case TOPOLOGY_OP_ADD_SERVER:
+		return fmt.Sprintf("add server %s to group %d", s.Addr, s.GroupId)
+	case TOPOLOGY_OP_INIT_SLOTS:
+		return fmt.Sprintf("init %d slots", slotNum)
+	case TOPOLOGY_OP_SET_SLOTS:
+		return fmt.Sprintf("set slots [%d, %d] online on group %d", s.From, s.To, s.GroupId)
+	case TOPOLOGY_OP_MIGRATE_SLOTS:
+		return fmt.Sprintf("migrate slots [%d, %d] to group %d", s.From, s.To, s.GroupId)
+	case TOPOLOGY_OP_REMOVE_SERVER:
+		return fmt.Sprintf("remove server %s from group %d", s.Addr, s.GroupId)
+	case TOPOLOGY_OP_DETACH_SERVER:
+		return fmt.Sprintf("detach server %s from group %d, it moved to another group", s.Addr, s.GroupId)
+	case TOPOLOGY_OP_REMOVE_GROUP:
+		return fmt.Sprintf("remove group %d", s.GroupId)
+	}
+	return s.Op
+}
+
+// TopologyPlan is the diff between the coordinator and a topology file.
+// Problems are differences the cli cannot fix, apply refuses to run while
+// there are any.
+type TopologyPlan struct {
+	Steps    []TopologyStep `json:"steps"`
+	Problems []string       `json:"problems,omitempty"`
+}
+
+var topologyFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:     "file",
+		Aliases:  []string{"f"},
+		Usage:    "topology file",
+		Required: true,
+	},
+	&cli.BoolFlag{
+		Name:  "prune",
+		Usage: "remove groups missing from the topology file",
+	},
+}
+
+func NewPlanCmd() *cli.Command {
+	return &cli.Command{
+		Name:        "plan",
+		Description: "plan -f <topology.yaml>, show the changes apply would make",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "output format (text, json)",
+				Value: "text",
+			},
+		}, topologyFlags...),
+		Before: loadSlotContext,
+		Action: runPlan,
+	}
+}
+
+func NewApplyCmd() *cli.Command {
+	return &cli.Command{
+		Name:        "apply",
+		Description: "apply -f <topology.yaml>, bring groups, servers and slots to the state declared in the file",
+		Flags: append([]cli.Flag{
+			&cli.IntFlag{
+				Name:  "delay",
+				Usage: "delay time in ms for migrations",
+			},
+			yesFlag,
+		}, append(append(migrateFlags, migrateCheckFlags...), topologyFlags...)...),
+		Before: loadSlotContext,
+		Action: withAudit(topologySnapshot, runApply),
+	}
+}
+
+func topologySnapshot(c *cli.Context) (interface{}, error) {
+	groups, err := store.ListGroup()
+	if err != nil {
+		return nil, err
+	}
+	slots, err := loadSlots(0, slotNum-1)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Groups map[int]*models.ServerGroup `json:"groups"`
+		Slots  []*models.Slot              `json:"slots"`
+	}{groups, slots}, nil
+}
+
+func parseSlotRanges(ranges []string) ([]int, error) {
+	var ids []int
+	for _, r := range ranges {
+		parts := strings.SplitN(strings.TrimSpace(r), "-", 2)
+		from, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, errors.Errorf("invalid slot range %q", r)
+		}
+		to := from
+		if len(parts) == 2 {
+			if to, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+				return nil, errors.Errorf("invalid slot range %q", r)
+			}
+		}
+		if err := checkSlotRange(from, to); err != nil {
+			return nil, errors.Annotatef(err, "slot range %q", r)
+		}
+		for i := from; i <= to; i++ {
+			ids = append(ids, i)
+		}
+	}
+	return ids, nil
+}
+
+func loadTopology(file string) (*Topology, map[int]int, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	t := &Topology{}
+	if err := yaml.UnmarshalStrict(b, t); err != nil {
+		return nil, nil, errors.Annotatef(err, "parse %s", file)
+	}
+	if t.Product != "" && t.Product != productName {
+		return nil, nil, errors.Errorf("topology is for product %q, configured product is %q", t.Product, productName)
+	}
+
+	// slot id -> group id
+	owners := make(map[int]int)
+	seen := make(map[int]bool)
+	servers := make(map[string]int)
+	for _, g := range t.Groups {
+		if g.Id <= 0 {
+			return nil, nil, errors.Errorf("invalid group id %d", g.Id)
+		}
+		if seen[g.Id] {
+			return nil, nil, errors.Errorf("group %d declared twice", g.Id)
+		}
+		seen[g.Id] = true
+		if len(g.Servers) == 0 {
+			return nil, nil, errors.Errorf("group %d has no server", g.Id)
+		}
+		for _, addr := range g.Servers {
+			if other, ok := servers[addr]; ok {
+				return nil, nil, errors.Errorf("server %s declared in group %d and group %d", addr, other, g.Id)
+			}
+			servers[addr] = g.Id
+		}
+		if g.Master != "" {
+			return nil, nil, errors.Errorf("group %d declares master %s, the cli cannot promote a server, remove the field", g.Id, g.Master)
+		}
+		ids, err := parseSlotRanges(g.Slots)
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "group %d", g.Id)
+		}
+		for _, id := range ids {
+			if other, ok := owners[id]; ok {
+				return nil, nil, errors.Errorf("slot %d declared in group %d and group %d", id, other, g.Id)
+			}
+			owners[id] = g.Id
+		}
+	}
+	return t, owners, nil
+}
+
+// addSlotStep appends the slot to the last step when it extends its range.
+func addSlotStep(steps []TopologyStep, op string, slotId, groupId int) []TopologyStep {
+	if n := len(steps); n > 0 {
+		last := &steps[n-1]
+		if last.Op == op && last.GroupId == groupId && last.To == slotId-1 {
+			last.To = slotId
+			return steps
+		}
+	}
+	return append(steps, TopologyStep{Op: op, GroupId: groupId, From: slotId, To: slotId})
+}
+
+func planTopology(t *Topology, owners map[int]int, prune bool) (*TopologyPlan, error) {
+	plan := &TopologyPlan{}
+	groups, err := store.ListGroup()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// servers first, slots can only be placed on groups that exist
+	declared := make(map[int]bool)
+	// server -> declared group
+	serverGroups := make(map[string]int)
+	for _, g := range t.Groups {
+		declared[g.Id] = true
+		for _, addr := range g.Servers {
+			serverGroups[addr] = g.Id
+		}
+	}
+	for _, g := range t.Groups {
+		cur := groups[g.Id]
+		for _, addr := range g.Servers {
+			if cur != nil {
+				if ok, _ := cur.ServerExists(addr); ok {
+					continue
+				}
+			}
+			plan.Steps = append(plan.Steps, TopologyStep{Op: TOPOLOGY_OP_ADD_SERVER, GroupId: g.Id, Addr: addr})
+		}
+	}
+
+	slots, err := loadSlots(0, slotNum-1)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	current := make(map[int]*models.Slot, len(slots))
+	for _, s := range slots {
+		current[s.Id] = s
+	}
+	if len(owners) > 0 && len(slots) == 0 {
+		plan.Steps = append(plan.Steps, TopologyStep{Op: TOPOLOGY_OP_INIT_SLOTS})
+	}
+
+	ids := make([]int, 0, len(owners))
+	for id := range owners {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var sets, migrates []TopologyStep
+	for _, id := range ids {
+		want := owners[id]
+		s := current[id]
+		switch {
+		case s == nil || s.GroupId == models.INVALID_ID:
+			// nothing served yet, no data to move
+			sets = addSlotStep(sets, TOPOLOGY_OP_SET_SLOTS, id, want)
+		case s.State.Status == models.SLOT_STATUS_OFFLINE && s.GroupId == want:
+			sets = addSlotStep(sets, TOPOLOGY_OP_SET_SLOTS, id, want)
+		case s.State.Status == models.SLOT_STATUS_OFFLINE:
+			// a migration skips offline slots, setting it on another group
+			// would leave its keys behind
+			plan.Problems = append(plan.Problems, fmt.Sprintf("slot %d is offline on group %d, bring it online with `slot set` before moving it to group %d", id, s.GroupId, want))
+		case s.State.Status == models.SLOT_STATUS_MIGRATE || s.State.Status == models.SLOT_STATUS_PRE_MIGRATE:
+			plan.Problems = append(plan.Problems, fmt.Sprintf("slot %d is migrating, finish it first or run `slot repair`", id))
+		case s.GroupId != want:
+			migrates = addSlotStep(migrates, TOPOLOGY_OP_MIGRATE_SLOTS, id, want)
+		}
+	}
+	plan.Steps = append(plan.Steps, sets...)
+	plan.Steps = append(plan.Steps, migrates...)
+
+	// removals last, once the slots have moved away
+	owned := make(map[int]bool)
+	for id, s := range current {
+		if want, ok := owners[id]; ok {
+			owned[want] = true
+		} else if s.GroupId != models.INVALID_ID {
+			owned[s.GroupId] = true
+		}
+	}
+	gids := make([]int, 0, len(groups))
+	for gid := range groups {
+		gids = append(gids, gid)
+	}
+	sort.Ints(gids)
+	for _, gid := range gids {
+		cur := groups[gid]
+		if !declared[gid] {
+			if !prune {
+				continue
+			}
+			if owned[gid] {
+				plan.Problems = append(plan.Problems, fmt.Sprintf("group %d still serves slots, declare where they go before removing it", gid))
+				continue
+			}
+			plan.Steps = append(plan.Steps, TopologyStep{Op: TOPOLOGY_OP_REMOVE_GROUP, GroupId: gid})
+			continue
+		}
+		for _, srv := range cur.Servers {
+			want, ok := serverGroups[srv.Addr]
+			switch {
+			case ok && want == gid:
+			case srv.Type == models.ServerTypeLeader:
+				// the group would be left without a master
+				plan.Problems = append(plan.Problems, fmt.Sprintf("server %s is the master of group %d, make another server of the group master before removing it", srv.Addr, gid))
+			case ok:
+				// the server record is shared with the group it moved to
+				plan.Steps = append(plan.Steps, TopologyStep{Op: TOPOLOGY_OP_DETACH_SERVER, GroupId: gid, Addr: srv.Addr})
+			default:
+				plan.Steps = append(plan.Steps, TopologyStep{Op: TOPOLOGY_OP_REMOVE_SERVER, GroupId: gid, Addr: srv.Addr})
+			}
+		}
+	}
+	return plan, nil
+}
+
+func applyTopologyStep(step TopologyStep, delay int) error {
+	switch step.Op {
+	case TOPOLOGY_OP_ADD_SERVER:
+		return addServerToGroup(step.GroupId, step.Addr)
+	case TOPOLOGY_OP_INIT_SLOTS:
+		return errors.Trace(store.InitSlotSet(productName, slotNum))
+	case TOPOLOGY_OP_SET_SLOTS:
+		return errors.Trace(store.SetSlotRange(productName, step.From, step.To, step.GroupId, models.SLOT_STATUS_ONLINE))
+	case TOPOLOGY_OP_MIGRATE_SLOTS:
+		t, err := newMigrateTask(step.From, step.To, step.GroupId, delay)
+		if err != nil {
+			return err
+		}
+		return runMigrate(t)
+	case TOPOLOGY_OP_REMOVE_SERVER:
+		return removeServerFromGroup(step.GroupId, step.Addr)
+	case TOPOLOGY_OP_DETACH_SERVER:
+		return detachServerFromGroup(step.GroupId, step.Addr)
+	case TOPOLOGY_OP_REMOVE_GROUP:
+		sg, err := store.LoadGroup(step.GroupId, true)
+		if err != nil {
+			return err
+		}
+		return removeServerGroup(sg)
+	}
+	return errors.Errorf("unknown step %q", step.Op)
+}
+
+func loadTopologyPlan(context *cli.Context) (*TopologyPlan, error) {
+	t, owners, err := loadTopology(context.String("file"))
+	if err != nil {
+		return nil, err
+	}
+	return planTopology(t, owners, context.Bool("prune"))
+}
+
+func printTopologyPlan(plan *TopologyPlan) {
+	if len(plan.Steps) == 0 {
+		fmt.Println("no changes, topology is up to date")
+	}
+	for i, step := range plan.Steps {
+		fmt.Printf("%3d. %s\n", i+1, step)
+	}
+	for _, p := range plan.Problems {
+		fmt.Printf("problem: %s\n", p)
+	}
+}
+
+func runPlan(context *cli.Context) error {
+	plan, err := loadTopologyPlan(context)
+	if err != nil {
+		return err
+	}
+	switch format := context.String("format"); format {
+	case "json":
+		b, _ := json.MarshalIndent(plan, " ", "  ")
+		fmt.Println(string(b))
+	case "text":
+		printTopologyPlan(plan)
+	default:
+		return errors.Errorf("invalid format %q, should be one of (text, json)", format)
+	}
+	return nil
+}
+
+func runApply(context *cli.Context) error {
+	if err := setMigrateOptions(context); err != nil {
+		return err
+	}
+	if err := setMigrateChecks(context); err != nil {
+		return err
+	}
+	plan, err := loadTopologyPlan(context)
+	if err != nil {
+		return err
+	}
+	printTopologyPlan(plan)
+	if len(plan.Problems) > 0 {
+		return errors.Errorf("topology has %d problems, fix them before applying", len(plan.Problems))
+	}
+	if len(plan.Steps) == 0 {
+		return nil
+	}
+
+	impact := make([]string, 0, len(plan.Steps))
+	for _, step := range plan.Steps {
+		impact = append(impact, step.String())
+	}
+	if err := confirm(context, impact); err != nil {
+		return err
+	}
+
+	for i, step := range plan.Steps {
+		log.Infof("apply step %d/%d: %s", i+1, len(plan.Steps), step)
+		if err := applyTopologyStep(step, context.Int("delay")); err != nil {
+			return errors.Annotatef(err, "step %d (%s)", i+1, step)
+		}
+	}
+	return nil
+}
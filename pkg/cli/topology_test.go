@@ -0,0 +1,173 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IceFireDB/kit/pkg/models"
+)
+
+func TestPlanTopologyMoveServer(t *testing.T) {
+	useMemStore(t, 4)
+	addTestServer(t, 1, "10.0.0.1:6380", models.ServerTypeLeader)
+	addTestServer(t, 1, "10.0.0.2:6380", models.ServerTypeFollower)
+	addTestServer(t, 2, "10.0.0.3:6380", models.ServerTypeLeader)
+
+	topo := &Topology{Groups: []TopologyGroup{
+		{Id: 1, Servers: []string{"10.0.0.1:6380"}},
+		{Id: 2, Servers: []string{"10.0.0.3:6380", "10.0.0.2:6380"}},
+	}}
+	plan, err := planTopology(topo, map[int]int{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TopologyStep{
+		{Op: TOPOLOGY_OP_ADD_SERVER, GroupId: 2, Addr: "10.0.0.2:6380"},
+		{Op: TOPOLOGY_OP_DETACH_SERVER, GroupId: 1, Addr: "10.0.0.2:6380"},
+	}
+	if len(plan.Steps) != len(want) {
+		t.Fatalf("steps %v, want %v", plan.Steps, want)
+	}
+	for i := range want {
+		if plan.Steps[i] != want[i] {
+			t.Errorf("step %d is %v, want %v", i, plan.Steps[i], want[i])
+		}
+	}
+
+	for _, step := range plan.Steps {
+		if err := applyTopologyStep(step, 0); err != nil {
+			t.Fatalf("apply %v: %v", step, err)
+		}
+	}
+	g, err := store.LoadGroup(2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := store.GetServers(g)
+	if err != nil {
+		t.Fatalf("servers of group 2 after the move: %v", err)
+	}
+	if len(servers) != 2 {
+		t.Errorf("group 2 has %d servers, want 2", len(servers))
+	}
+	if g, _ := store.LoadGroup(1, true); len(g.Servers) != 1 {
+		t.Errorf("group 1 has %d servers, want 1", len(g.Servers))
+	}
+}
+
+func TestPlanTopologyRemoveServer(t *testing.T) {
+	useMemStore(t, 4)
+	addTestServer(t, 1, "10.0.0.1:6380", models.ServerTypeLeader)
+	addTestServer(t, 1, "10.0.0.2:6380", models.ServerTypeFollower)
+
+	topo := &Topology{Groups: []TopologyGroup{
+		{Id: 1, Servers: []string{"10.0.0.1:6380"}},
+	}}
+	plan, err := planTopology(topo, map[int]int{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Steps) != 1 || plan.Steps[0].Op != TOPOLOGY_OP_REMOVE_SERVER {
+		t.Fatalf("steps %v, want one remove-server", plan.Steps)
+	}
+	if err := applyTopologyStep(plan.Steps[0], 0); err != nil {
+		t.Fatal(err)
+	}
+	if srv, _ := store.GetServer("10.0.0.2:6380", false); srv != nil {
+		t.Errorf("server record of a removed server is kept")
+	}
+}
+
+func TestPlanTopologyRemoveMaster(t *testing.T) {
+	useMemStore(t, 4)
+	addTestServer(t, 1, "10.0.0.1:6380", models.ServerTypeLeader)
+	addTestServer(t, 1, "10.0.0.2:6380", models.ServerTypeFollower)
+	addTestServer(t, 2, "10.0.0.3:6380", models.ServerTypeLeader)
+
+	for _, servers := range [][]string{
+		// removed
+		{"10.0.0.3:6380"},
+		// moved to another group
+		{"10.0.0.3:6380", "10.0.0.1:6380"},
+	} {
+		topo := &Topology{Groups: []TopologyGroup{
+			{Id: 1, Servers: []string{"10.0.0.2:6380"}},
+			{Id: 2, Servers: servers},
+		}}
+		plan, err := planTopology(topo, map[int]int{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, p := range plan.Problems {
+			if strings.Contains(p, "10.0.0.1:6380 is the master of group 1") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("group 2 servers %v: problems %v, want the master of group 1 named", servers, plan.Problems)
+		}
+		for _, step := range plan.Steps {
+			if step.GroupId == 1 && step.Addr == "10.0.0.1:6380" {
+				t.Errorf("group 2 servers %v: master of group 1 is removed by step %v", servers, step)
+			}
+		}
+	}
+}
+
+func TestPlanTopologyOfflineSlot(t *testing.T) {
+	useMemStore(t, 4)
+	addTestServer(t, 1, "10.0.0.1:6380", models.ServerTypeLeader)
+	addTestServer(t, 2, "10.0.0.2:6380", models.ServerTypeLeader)
+	for id, g := range []int{1, 1, 1, models.INVALID_ID} {
+		s := models.NewSlot(productName, id)
+		s.GroupId = g
+		s.State.Status = models.SLOT_STATUS_OFFLINE
+		if err := store.UpdateSlotWithoutAction(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	topo := &Topology{Groups: []TopologyGroup{
+		{Id: 1, Servers: []string{"10.0.0.1:6380"}},
+		{Id: 2, Servers: []string{"10.0.0.2:6380"}},
+	}}
+	// slot 0 stays on group 1, slot 1 moves while offline with its keys on
+	// group 1, slot 3 was never assigned
+	plan, err := planTopology(topo, map[int]int{0: 1, 1: 2, 3: 2}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TopologyStep{
+		{Op: TOPOLOGY_OP_SET_SLOTS, GroupId: 1, From: 0, To: 0},
+		{Op: TOPOLOGY_OP_SET_SLOTS, GroupId: 2, From: 3, To: 3},
+	}
+	if len(plan.Steps) != len(want) {
+		t.Fatalf("steps %v, want %v", plan.Steps, want)
+	}
+	for i := range want {
+		if plan.Steps[i] != want[i] {
+			t.Errorf("step %d is %v, want %v", i, plan.Steps[i], want[i])
+		}
+	}
+	if len(plan.Problems) != 1 || !strings.Contains(plan.Problems[0], "slot 1 is offline on group 1") {
+		t.Errorf("problems %v, want slot 1 offline on group 1", plan.Problems)
+	}
+}
+
+func TestLoadTopologyMaster(t *testing.T) {
+	useMemStore(t, 4)
+	file := filepath.Join(t.TempDir(), "topology.yaml")
+	b := []byte("groups:\n  - id: 1\n    servers: [10.0.0.1:6380]\n    master: 10.0.0.1:6380\n")
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadTopology(file); err == nil || !strings.Contains(err.Error(), "cannot promote") {
+		t.Errorf("topology with a master: %v", err)
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/IceFireDB/kit/pkg/models"
+	"github.com/juju/errors"
+	"github.com/urfave/cli/v2"
+
+	log "github.com/IceFireDB/cli/pkg/log"
+)
+
+const defaultWatchInterval = 5 * time.Second
+
+const (
+	WATCH_EVENT_ADDED   string = "added"
+	WATCH_EVENT_REMOVED string = "removed"
+	WATCH_EVENT_CHANGED string = "changed"
+)
+
+// WatchEvent is a change of the product seen by `slot watch` or
+// `server watch`. Kind is one of slot, group, server or cli.
+type WatchEvent struct {
+	Ts     int64  `json:"ts"`
+	Kind   string `json:"kind"`
+	Id     string `json:"id"`
+	Action string `json:"action"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+func (e *WatchEvent) String() string {
+	s := fmt.Sprintf("%s %s %s %s", time.Unix(e.Ts, 0).Format(time.RFC3339), e.Kind, e.Id, e.Action)
+	switch e.Action {
+	case WATCH_EVENT_ADDED:
+		s += ": " + e.After
+	case WATCH_EVENT_REMOVED:
+		s += ": " + e.Before
+	case WATCH_EVENT_CHANGED:
+		s += ": " + e.Before + " -> " + e.After
+	}
+	return s
+}
+
+// watchState is a snapshot of the watched paths, events are computed by
+// comparing two snapshots since the coordinator watch only tells that
+// something changed.
+type watchState interface {
+	eventsSince(prev watchState) []*WatchEvent
+}
+
+var watchFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "format",
+		Usage: "output format (text, json)",
+		Value: "text",
+	},
+	&cli.DurationFlag{
+		Name:  "interval",
+		Usage: "also poll the coordinator at this interval, catches changes the watch misses (zk data changes, etcd deletes), 0 to disable",
+		Value: defaultWatchInterval,
+	},
+}
+
+func newSlotWatchCmd() *cli.Command {
+	return &cli.Command{
+		Name:        "watch",
+		Description: "print slot status changes as they happen, until interrupted",
+		Flags:       watchFlags,
+		Action: func(context *cli.Context) error {
+			return runWatch(context, []string{store.SlotDir()}, loadSlotWatchState)
+		},
+	}
+}
+
+func newServerWatchCmd() *cli.Command {
+	return &cli.Command{
+		Name:        "watch",
+		Description: "print group membership, server type and active cli changes as they happen, until interrupted",
+		Flags:       watchFlags,
+		Action: func(context *cli.Context) error {
+			return runWatch(context, []string{store.GroupDir(), store.ServerDir(), store.CliDir()}, loadServerWatchState)
+		},
+	}
+}
+
+type slotWatchState map[int]models.Slot
+
+func loadSlotWatchState() (watchState, error) {
+	slots, err := store.Slots()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	st := make(slotWatchState, len(slots))
+	for _, s := range slots {
+		st[s.Id] = s
+	}
+	return st, nil
+}
+
+func describeSlot(s *models.Slot) string {
+	switch s.State.Status {
+	case models.SLOT_STATUS_MIGRATE, models.SLOT_STATUS_PRE_MIGRATE:
+		return fmt.Sprintf("%s %d -> %d", s.State.Status, s.State.MigrateStatus.From, s.State.MigrateStatus.To)
+	case models.SLOT_STATUS_ONLINE:
+		return fmt.Sprintf("online on group %d", s.GroupId)
+	}
+	return string(s.State.Status)
+}
+
+func (st slotWatchState) eventsSince(prev watchState) []*WatchEvent {
+	before := prev.(slotWatchState)
+	ids := make(map[int]bool, len(st))
+	for id := range st {
+		ids[id] = true
+	}
+	for id := range before {
+		ids[id] = true
+	}
+	sorted := make([]int, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Ints(sorted)
+
+	var events []*WatchEvent
+	for _, id := range sorted {
+		e := &WatchEvent{Kind: "slot", Id: strconv.Itoa(id)}
+		old, hadOld := before[id]
+		cur, hasCur := st[id]
+		if hadOld {
+			e.Before = describeSlot(&old)
+		}
+		if hasCur {
+			e.After = describeSlot(&cur)
+		}
+		switch {
+		case !hadOld:
+			e.Action = WATCH_EVENT_ADDED
+		case !hasCur:
+			e.Action = WATCH_EVENT_REMOVED
+		case e.Before != e.After:
+			e.Action = WATCH_EVENT_CHANGED
+		default:
+			continue
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+type serverWatchState struct {
+	// group id -> server addr -> server type
+	groups map[int]map[string]models.ServerType
+	// registration name -> host and pid
+	clis map[string]string
+}
+
+func loadServerWatchState() (watchState, error) {
+	groups, err := store.ListGroup()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	st := &serverWatchState{
+		groups: make(map[int]map[string]models.ServerType, len(groups)),
+		clis:   make(map[string]string),
+	}
+	for gid, g := range groups {
+		servers := make(map[string]models.ServerType, len(g.Servers))
+		for _, srv := range g.Servers {
+			s, err := store.GetServer(srv.Addr, false)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if s == nil {
+				servers[srv.Addr] = "unregistered"
+				continue
+			}
+			servers[srv.Addr] = s.Type
+		}
+		st.groups[gid] = servers
+	}
+
+	paths, err := store.Client().List(store.CliDir(), false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, p := range paths {
+		b, err := store.Client().Read(p, false)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		desc := ""
+		l := &models.Lock{}
+		if b != nil && json.Unmarshal(b, l) == nil {
+			desc = fmt.Sprintf("host %s pid %d", l.Hostname, l.Pid)
+		}
+		st.clis[path.Base(p)] = desc
+	}
+	return st, nil
+}
+
+func (st *serverWatchState) eventsSince(prev watchState) []*WatchEvent {
+	before := prev.(*serverWatchState)
+	var events []*WatchEvent
+
+	gids := make(map[int]bool)
+	for gid := range st.groups {
+		gids[gid] = true
+	}
+	for gid := range before.groups {
+		gids[gid] = true
+	}
+	sorted := make([]int, 0, len(gids))
+	for gid := range gids {
+		sorted = append(sorted, gid)
+	}
+	sort.Ints(sorted)
+
+	for _, gid := range sorted {
+		old, hadOld := before.groups[gid]
+		cur, hasCur := st.groups[gid]
+		id := strconv.Itoa(gid)
+		switch {
+		case !hadOld:
+			events = append(events, &WatchEvent{Kind: "group", Id: id, Action: WATCH_EVENT_ADDED, After: describeServers(cur)})
+		case !hasCur:
+			events = append(events, &WatchEvent{Kind: "group", Id: id, Action: WATCH_EVENT_REMOVED, Before: describeServers(old)})
+			continue
+		}
+		for _, addr := range sortedAddrs(old, cur) {
+			oldType, hadServer := old[addr]
+			curType, hasServer := cur[addr]
+			e := &WatchEvent{Kind: "server", Id: addr}
+			switch {
+			case !hadServer:
+				e.Action, e.After = WATCH_EVENT_ADDED, fmt.Sprintf("%s in group %d", curType, gid)
+			case !hasServer:
+				e.Action, e.Before = WATCH_EVENT_REMOVED, fmt.Sprintf("%s in group %d", oldType, gid)
+			case oldType != curType:
+				e.Action, e.Before, e.After = WATCH_EVENT_CHANGED, string(oldType), string(curType)
+			default:
+				continue
+			}
+			events = append(events, e)
+		}
+	}
+
+	names := make(map[string]bool)
+	for name := range st.clis {
+		names[name] = true
+	}
+	for name := range before.clis {
+		names[name] = true
+	}
+	sortedNames := make([]string, 0, len(names))
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+	for _, name := range sortedNames {
+		old, hadOld := before.clis[name]
+		cur, hasCur := st.clis[name]
+		switch {
+		case !hadOld:
+			events = append(events, &WatchEvent{Kind: "cli", Id: name, Action: WATCH_EVENT_ADDED, After: cur})
+		case !hasCur:
+			events = append(events, &WatchEvent{Kind: "cli", Id: name, Action: WATCH_EVENT_REMOVED, Before: old})
+		}
+	}
+	return events
+}
+
+func sortedAddrs(a, b map[string]models.ServerType) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	var addrs []string
+	for _, m := range []map[string]models.ServerType{a, b} {
+		for addr := range m {
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func describeServers(servers map[string]models.ServerType) string {
+	s := ""
+	for i, addr := range sortedAddrs(servers, nil) {
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%s(%s)", addr, servers[addr])
+	}
+	return s
+}
+
+// watchDirs signals on the returned channel whenever one of dirs changes.
+// The kit client watches fire once, so each dir is watched again after
+// every change.
+func watchDirs(dirs []string, retry time.Duration) <-chan struct{} {
+	notify := make(chan struct{}, 1)
+	for _, dir := range dirs {
+		go func(dir string) {
+			for {
+				ch, _, err := store.Client().WatchInOrder(dir)
+				if err != nil {
+					log.Debugf("watch %s failed: %v", dir, err)
+					time.Sleep(retry)
+					continue
+				}
+				for range ch {
+				}
+				select {
+				case notify <- struct{}{}:
+				default:
+				}
+			}
+		}(dir)
+	}
+	return notify
+}
+
+func printWatchEvent(e *WatchEvent, format string) {
+	if format == "json" {
+		b, _ := json.Marshal(e)
+		fmt.Println(string(b))
+		return
+	}
+	fmt.Println(e.String())
+}
+
+func runWatch(context *cli.Context, dirs []string, load func() (watchState, error)) error {
+	format := context.String("format")
+	if format != "text" && format != "json" {
+		return errors.Errorf("invalid format %q, should be one of (text, json)", format)
+	}
+	interval := context.Duration("interval")
+	retry := interval
+	if retry <= 0 {
+		retry = defaultWatchInterval
+	}
+
+	prev, err := load()
+	if err != nil {
+		return err
+	}
+	notify := watchDirs(dirs, retry)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	log.Infof("watching %v, press ctrl-c to stop", dirs)
+
+	for {
+		select {
+		case <-notify:
+		case <-tick:
+		}
+		cur, err := load()
+		if err != nil {
+			log.Warnf("reload after change failed: %v", err)
+			continue
+		}
+		ts := time.Now().Unix()
+		for _, e := range cur.eventsSince(prev) {
+			e.Ts = ts
+			printWatchEvent(e, format)
+		}
+		prev = cur
+	}
+}
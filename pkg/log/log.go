@@ -0,0 +1,107 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+// Package log is the logger of the cli. It has the api and the output of
+// the kit logger and can also write to a log file.
+package log
+
+import (
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// LogLevel is the level of a message.
+type LogLevel string
+
+const (
+	DebugLevel LogLevel = "debug"
+	InfoLevel  LogLevel = "info"
+	WarnLevel  LogLevel = "warn"
+	ErrorLevel LogLevel = "error"
+	FatalLevel LogLevel = "fatal"
+)
+
+// Option sets up the logger created by Init.
+type Option func(l *logrus.Logger) error
+
+// WithOutputLevelString sets the lowest level written.
+func WithOutputLevelString(level string) Option {
+	return func(l *logrus.Logger) error {
+		switch LogLevel(strings.ToLower(level)) {
+		case DebugLevel, InfoLevel, WarnLevel, ErrorLevel, FatalLevel:
+		default:
+			return errors.Errorf("invalid log level %q, should be one of (debug, info, warn, error, fatal)", level)
+		}
+		lvl, err := logrus.ParseLevel(level)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		l.SetLevel(lvl)
+		return nil
+	}
+}
+
+// WithOutputFormat writes json lines instead of text.
+func WithOutputFormat(json bool) Option {
+	return func(l *logrus.Logger) error {
+		if json {
+			l.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+		} else {
+			l.SetFormatter(&logrus.TextFormatter{TimestampFormat: time.RFC3339Nano})
+		}
+		return nil
+	}
+}
+
+// WithOutput writes to w instead of os.Stdout.
+func WithOutput(w io.Writer) Option {
+	return func(l *logrus.Logger) error {
+		l.SetOutput(w)
+		return nil
+	}
+}
+
+var global, _ = newEntry("cli")
+
+func newEntry(name string, options ...Option) (*logrus.Entry, error) {
+	l := logrus.New()
+	l.SetOutput(os.Stdout)
+	l.SetFormatter(&logrus.TextFormatter{TimestampFormat: time.RFC3339Nano})
+	for _, o := range options {
+		if err := o(l); err != nil {
+			return nil, err
+		}
+	}
+	hostname, _ := os.Hostname()
+	return l.WithFields(logrus.Fields{
+		"scope":    name,
+		"type":     "log",
+		"instance": hostname,
+	}), nil
+}
+
+// Init replaces the global logger, which is kept when an option fails.
+func Init(name string, options ...Option) error {
+	e, err := newEntry(name, options...)
+	if err != nil {
+		return err
+	}
+	global = e
+	return nil
+}
+
+func Info(args ...interface{})                  { global.Info(args...) }
+func Infof(format string, args ...interface{})  { global.Infof(format, args...) }
+func Debug(args ...interface{})                 { global.Debug(args...) }
+func Debugf(format string, args ...interface{}) { global.Debugf(format, args...) }
+func Warn(args ...interface{})                  { global.Warn(args...) }
+func Warnf(format string, args ...interface{})  { global.Warnf(format, args...) }
+func Error(args ...interface{})                 { global.Error(args...) }
+func Errorf(format string, args ...interface{}) { global.Errorf(format, args...) }
+func Fatal(args ...interface{})                 { global.Fatal(args...) }
+func Fatalf(format string, args ...interface{}) { global.Fatalf(format, args...) }
@@ -1,10 +1,10 @@
 #!/bin/sh
 echo "slots initializing..."
-../bin/cli -c config.ini slot init -f true
+../bin/cli -c config.ini slot init -f --yes
 echo "done"
 
 echo "set slot ranges to server groups..."
-../bin/cli -c config.ini slot range-set 0 63 1 online
-../bin/cli -c config.ini slot range-set 64 127 2 online
+../bin/cli -c config.ini slot range-set --yes 0 63 1 online
+../bin/cli -c config.ini slot range-set --yes 64 127 2 online
 echo "done"
 